@@ -2,13 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/cobra"
-	"github.com/shyn/kiro2cc/internal/auth"
 	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/usage"
 )
 
 var claudeCmd = &cobra.Command{
@@ -18,15 +20,17 @@ var claudeCmd = &cobra.Command{
 1. Checking if the kiro2cc server is running.
 2. Starting the server in the background if it's not running.
 3. Refreshing the authentication token.
-4. Setting the necessary environment variables (ANTHROPIC_BASE_URL, ANTHROPIC_API_KEY).
+4. Setting the necessary environment variables (ANTHROPIC_BASE_URL,
+   ANTHROPIC_API_KEY to a local kiro2cc API key, never the Kiro token, and
+   an ANTHROPIC_CUSTOM_HEADERS project header for the usage ledger).
 5. Executing 'claude' with any provided arguments.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Default()
+		cfg, err := config.Load()
 		if err != nil {
 			return fmt.Errorf("failed to get config: %w", err)
 		}
 
-		if !isRunning(cfg.Server.PIDFilePath) {
+		if _, ok := runningPID(cfg.Server.PIDFilePath); !ok && !serverHealthy(cfg) {
 			fmt.Println("Server not running, starting it in the background...")
 			if err := startDaemon(cfg); err != nil {
 				return fmt.Errorf("failed to start server daemon: %w", err)
@@ -36,19 +40,34 @@ var claudeCmd = &cobra.Command{
 		}
 
 		fmt.Println("Refreshing token...")
-		authService := auth.NewService(cfg)
-		if err := authService.RefreshToken(); err != nil {
-			return fmt.Errorf("failed to refresh token: %w", err)
+		authService, err := selectedAccount(cfg)
+		if err != nil {
+			return err
+		}
+		if accountName == "" && len(cfg.AccountList()) > 1 {
+			err = refreshAllAccounts(cfg)
+		} else {
+			err = authService.RefreshToken()
 		}
-		token, err := authService.GetToken()
 		if err != nil {
-			return fmt.Errorf("failed to get token after refresh: %w", err)
+			return fmt.Errorf("failed to refresh token: %w", err)
 		}
 		fmt.Println("Token refreshed successfully.")
 
-		baseURL := fmt.Sprintf("http://localhost:%s", cfg.Server.Port)
+		apiKey, err := cliAPIKey(cfg)
+		if err != nil {
+			return err
+		}
+
+		baseURL, err := proxyBaseURL(cfg)
+		if err != nil {
+			return err
+		}
 		os.Setenv("ANTHROPIC_BASE_URL", baseURL)
-		os.Setenv("ANTHROPIC_API_KEY", token.AccessToken)
+		os.Setenv("ANTHROPIC_API_KEY", apiKey)
+		if cwd, err := os.Getwd(); err == nil {
+			os.Setenv("ANTHROPIC_CUSTOM_HEADERS", withCustomHeader(os.Getenv("ANTHROPIC_CUSTOM_HEADERS"), usage.ProjectHeader, url.PathEscape(cwd)))
+		}
 
 		claudePath, err := exec.LookPath("claude")
 		if err != nil {
@@ -69,4 +88,17 @@ var claudeCmd = &cobra.Command{
 
 func init() {
 	// Command is added in root.go
+}
+
+// withCustomHeader adds a header to an ANTHROPIC_CUSTOM_HEADERS value,
+// which holds one "Name: value" per line, replacing any earlier value.
+func withCustomHeader(headers, name, value string) string {
+	var lines []string
+	for _, line := range strings.Split(headers, "\n") {
+		if field, _, _ := strings.Cut(line, ":"); line == "" || strings.EqualFold(strings.TrimSpace(field), name) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(append(lines, name+": "+value), "\n")
 }
\ No newline at end of file
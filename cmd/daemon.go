@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/proxy"
+)
+
+// daemonReadyTimeout is how long `server --daemon` waits for the new
+// server to answer /health.
+const daemonReadyTimeout = 15 * time.Second
+
+// processCommandLine returns the arguments a running process was started
+// with.
+func processCommandLine(pid int) ([]string, error) {
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+		return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+	}
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// isServerProcess reports whether pid is a running kiro2cc server, so that
+// a PID file naming a dead process, or a PID the system has since handed
+// to another program, is recognized as stale.
+func isServerProcess(pid int) bool {
+	args, err := processCommandLine(pid)
+	if err != nil || len(args) < 2 {
+		return false
+	}
+	name := filepath.Base(args[0])
+	if self, err := os.Executable(); (err != nil || name != filepath.Base(self)) && !strings.Contains(name, "kiro2cc") {
+		return false
+	}
+	return slices.Contains(args[1:], "server")
+}
+
+// adminClient returns an HTTP client and base URL for talking to the
+// local server on its first listen address, which may be a unix socket.
+func adminClient(cfg *config.Config) (*http.Client, string, error) {
+	addresses := cfg.ListenAddresses()
+	if path, ok := config.UnixSocketPath(addresses[0]); ok {
+		var dialer net.Dialer
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		}
+		return client, "http://kiro2cc", nil
+	}
+
+	baseURL, err := proxyBaseURL(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	return &http.Client{Timeout: 5 * time.Second}, baseURL, nil
+}
+
+// serverHealthy reports whether a server answers /health.
+func serverHealthy(cfg *config.Config) bool {
+	client, baseURL, err := adminClient(cfg)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Get(baseURL + "/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// fetchStatus asks the running server for its status.
+func fetchStatus(cfg *config.Config) (*proxy.Status, error) {
+	client, baseURL, err := adminClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/admin/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Server.RequireAPIKey {
+		apiKey, err := savedCLIAPIKey(cfg)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-api-key", apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status endpoint returned %s", resp.Status)
+	}
+
+	var status proxy.Status
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse status: %w", err)
+	}
+	return &status, nil
+}
+
+// waitForReady polls /health until the daemon answers, it exits, or the
+// timeout passes.
+func waitForReady(cfg *config.Config, exited <-chan error, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				return fmt.Errorf("server exited during startup")
+			}
+			return fmt.Errorf("server exited during startup: %w", err)
+		case <-deadline:
+			return fmt.Errorf("server did not become ready within %v", timeout)
+		case <-tick.C:
+			if serverHealthy(cfg) {
+				return nil
+			}
+		}
+	}
+}
+
+// tailFile returns up to the last n lines written to a file after offset.
+func tailFile(path string, offset int64, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/apikeys"
+	"github.com/shyn/kiro2cc/internal/auth"
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// cliKeyName is the key kiro2cc issues to itself for `claude` and `export`.
+const cliKeyName = "kiro2cc-cli"
+
+var keyName string
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage local API keys for the proxy",
+	Long:  "Create, list and revoke the API keys clients must present to the kiro2cc proxy.",
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a new API key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		key, secret, err := keyStore(cfg).Create(keyName)
+		if err != nil {
+			return fmt.Errorf("failed to create key: %w", err)
+		}
+
+		fmt.Printf("Created key %s (%s).\n", key.ID, key.Name)
+		if keyName == cliKeyName {
+			if err := auth.NewSecretStore(cfg).Save(cliKeySlot(cfg), []byte(secret)); err != nil {
+				return fmt.Errorf("failed to save API key: %w", err)
+			}
+			fmt.Println("'kiro2cc claude' and 'kiro2cc export' will use it.")
+			return nil
+		}
+		fmt.Println("Store it now, it cannot be shown again:")
+		fmt.Println(secret)
+		return nil
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API keys",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		keys, err := keyStore(cfg).List()
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 && len(cfg.Server.APIKeys) == 0 {
+			fmt.Println("No API keys. Create one with 'kiro2cc keys create'.")
+			return nil
+		}
+
+		fmt.Printf("%-14s %-20s %-20s %-20s %s\n", "ID", "NAME", "KEY", "CREATED", "STATUS")
+		for _, key := range keys {
+			status := "active"
+			if key.Revoked() {
+				status = "revoked " + key.RevokedAt.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%-14s %-20s %-20s %-20s %s\n", key.ID, key.Name, key.Prefix, key.CreatedAt.Local().Format("2006-01-02 15:04"), status)
+		}
+		if n := len(cfg.Server.APIKeys); n > 0 {
+			fmt.Printf("\nPlus %d key(s) from the config file.\n", n)
+		}
+		return nil
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke <id|name>",
+	Short: "Revoke an API key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		revoked, err := keyStore(cfg).Revoke(args[0])
+		if err != nil {
+			return err
+		}
+		for _, key := range revoked {
+			fmt.Printf("Revoked key %s (%s).\n", key.ID, key.Name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	keysCreateCmd.Flags().StringVar(&keyName, "name", "default", "A name to recognize the key by")
+	keysCmd.AddCommand(keysCreateCmd)
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysRevokeCmd)
+}
+
+func keyStore(cfg *config.Config) *apikeys.Store {
+	return apikeys.NewStore(cfg.Server.KeysFilePath, cfg.Server.APIKeys)
+}
+
+// cliKeySlot is where the secret of the kiro2cc-cli key is kept, in the
+// same secret store as the Kiro tokens.
+func cliKeySlot(cfg *config.Config) config.AccountConfig {
+	return config.AccountConfig{
+		Name:          cliKeyName,
+		TokenFilePath: filepath.Join(filepath.Dir(cfg.Server.KeysFilePath), "cli-api-key.json"),
+	}
+}
+
+// savedCLIAPIKey returns the kiro2cc-cli secret without issuing one, for
+// commands such as status that must not change credentials.
+func savedCLIAPIKey(cfg *config.Config) (string, error) {
+	data, err := auth.NewSecretStore(cfg).Load(cliKeySlot(cfg))
+	if errors.Is(err, auth.ErrSecretNotFound) {
+		return "", fmt.Errorf("no %s API key has been issued yet, 'kiro2cc claude' or 'kiro2cc export' creates one", cliKeyName)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load API key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// cliAPIKey returns the key kiro2cc hands to claude-code and other local
+// tools, issuing one on first use. A key an admin revoked is not replaced
+// behind their back.
+func cliAPIKey(cfg *config.Config) (string, error) {
+	store := keyStore(cfg)
+	secrets := auth.NewSecretStore(cfg)
+	slot := cliKeySlot(cfg)
+
+	data, err := secrets.Load(slot)
+	if err == nil {
+		secret := strings.TrimSpace(string(data))
+		if _, err := store.Authenticate(secret); err == nil {
+			return secret, nil
+		} else if !errors.Is(err, apikeys.ErrInvalidKey) {
+			return "", err
+		}
+		return "", fmt.Errorf("the %s API key has been revoked, run 'kiro2cc keys create --name %s' to issue a new one", cliKeyName, cliKeyName)
+	} else if !errors.Is(err, auth.ErrSecretNotFound) {
+		return "", fmt.Errorf("failed to load API key: %w", err)
+	}
+
+	// The secret was never saved or has been lost: retire any key it
+	// belonged to and issue a fresh one.
+	store.Revoke(cliKeyName)
+	_, secret, err := store.Create(cliKeyName)
+	if err != nil {
+		return "", fmt.Errorf("failed to create API key: %w", err)
+	}
+	if err := secrets.Save(slot, []byte(secret)); err != nil {
+		return "", fmt.Errorf("failed to save API key: %w", err)
+	}
+	return secret, nil
+}
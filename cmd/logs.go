@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/logfile"
+)
+
+var (
+	logsFollow bool
+	logsSince  string
+	logsLines  int
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show the log of the background server",
+	Long: `Prints the last lines of the kiro2cc server log, including rotated files
+when needed. --since accepts a duration such as 10m or a time such as
+2006-01-02T15:04:05Z07:00 or "2006-01-02 15:04".`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		var since time.Time
+		lines := logsLines
+		if logsSince != "" {
+			if since, err = parseSince(logsSince, time.Now()); err != nil {
+				return err
+			}
+			if !cmd.Flags().Changed("lines") {
+				lines = 0
+			}
+		}
+
+		offset, err := printLogs(os.Stdout, cfg.Log.File, since, lines)
+		if err != nil {
+			return err
+		}
+		if logsFollow {
+			return followLog(os.Stdout, cfg.Log.File, offset)
+		}
+		return nil
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "Keep printing new lines as they are logged")
+	logsCmd.Flags().StringVar(&logsSince, "since", "", "Only show lines logged since this time or for this long")
+	logsCmd.Flags().IntVarP(&logsLines, "lines", "n", 100, "Number of lines to show, 0 for all")
+}
+
+// parseSince accepts a duration before now, which may be a number of days
+// such as 7d, or an absolute time.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, use a duration such as 10m or 7d, or a time such as 2006-01-02 15:04", value)
+}
+
+// lineTime returns the timestamp a log line starts with, if any.
+func lineTime(line string) (time.Time, bool) {
+	// Text records start with time=..., JSON records with {"time":"...".
+	if rest, ok := strings.CutPrefix(line, "time="); ok {
+		field, _, _ := strings.Cut(rest, " ")
+		if t, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return t, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(line, `{"time":"`); ok {
+		field, _, _ := strings.Cut(rest, `"`)
+		if t, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return t, true
+		}
+	}
+	// Older kiro2cc lines start with an RFC 3339 timestamp.
+	if field, _, _ := strings.Cut(line, " "); len(field) >= 20 {
+		if t, err := time.Parse(time.RFC3339, field); err == nil {
+			return t, true
+		}
+	}
+	// Lines from the standard log package start with "2006/01/02 15:04:05".
+	if len(line) >= 19 {
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", line[:19], time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// printLogs writes the lines logged since since, or the last n of them
+// when n is positive, reading rotated files as needed. It returns the
+// size of the current log file it read up to.
+func printLogs(w io.Writer, path string, since time.Time, n int) (int64, error) {
+	backups, err := logfile.Backups(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var tail []string
+	var offset int64
+	for _, file := range append(backups, path) {
+		r, err := logfile.OpenReader(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Lines without a timestamp belong to the line before them.
+		keep := since.IsZero()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if file == path {
+				offset += int64(len(line)) + 1
+			}
+			if t, ok := lineTime(line); ok && !since.IsZero() {
+				keep = !t.Before(since)
+			}
+			if !keep {
+				continue
+			}
+			tail = append(tail, line)
+			if n > 0 && len(tail) > n {
+				tail = tail[1:]
+			}
+		}
+		r.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+
+	for _, line := range tail {
+		fmt.Fprintln(w, line)
+	}
+	return offset, nil
+}
+
+// followLog prints what is appended to the log file from offset on,
+// starting over at the top of the new file when the log rotates.
+func followLog(w io.Writer, path string, offset int64) error {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if f != nil {
+				if _, err := f.Seek(offset, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
+
+		if f != nil {
+			n, err := f.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				offset += int64(n)
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if rotated(f, path) {
+				// Catch anything written just before the rotation.
+				io.Copy(w, f)
+				f.Close()
+				f, offset = nil, 0
+				continue
+			}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// rotated reports whether the file at path is no longer the open file f.
+func rotated(f *os.File, path string) bool {
+	current, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	open, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(open, current)
+}
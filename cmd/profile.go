@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage the CodeWhisperer profile used for requests",
+	Long:  "List the CodeWhisperer profiles available to an account and choose which one kiro2cc sends with requests.",
+}
+
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the profiles available to the account",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+		authService, err := selectedAccount(cfg)
+		if err != nil {
+			return err
+		}
+
+		profiles, err := authService.DiscoverProfiles()
+		if err != nil {
+			return err
+		}
+		if len(profiles) == 0 {
+			fmt.Println("No profiles are available to this account.")
+			return nil
+		}
+
+		token, err := authService.GetToken()
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		for _, p := range profiles {
+			marker := " "
+			if p.Arn == token.ProfileArn {
+				marker = "*"
+			}
+			fmt.Printf("%s %-24s %s\n", marker, p.ProfileName, p.Arn)
+		}
+		return nil
+	},
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:   "use <arn|name>",
+	Short: "Select the profile sent with requests",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+		authService, err := selectedAccount(cfg)
+		if err != nil {
+			return err
+		}
+
+		if err := authService.UseProfile(args[0]); err != nil {
+			return err
+		}
+
+		token, err := authService.GetToken()
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		fmt.Printf("Now using profile %s\n", token.ProfileArn)
+		return nil
+	},
+}
+
+func init() {
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileUseCmd)
+}
@@ -1,36 +1,125 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/shyn/kiro2cc/internal/auth"
 	"github.com/shyn/kiro2cc/internal/config"
 )
 
+var (
+	reveal   bool
+	readJSON bool
+)
+
+// tokenInfo is what `kiro2cc read` reports about a token.
+type tokenInfo struct {
+	Account          string     `json:"account"`
+	Source           string     `json:"source"`
+	Region           string     `json:"region"`
+	ProfileArn       string     `json:"profileArn,omitempty"`
+	ProfileError     string     `json:"profileError,omitempty"`
+	AccessToken      string     `json:"accessToken"`
+	RefreshToken     string     `json:"refreshToken"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	ExpiresInSeconds *int64     `json:"expiresInSeconds,omitempty"`
+	Expired          bool       `json:"expired"`
+}
+
 var readCmd = &cobra.Command{
 	Use:   "read",
 	Short: "Read and display token information",
-	Long:  "Read the Kiro authentication token from the cache and display its information.",
+	Long: `Read the Kiro authentication token from the cache and display its information.
+Tokens are masked unless --reveal is given.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Default()
+		cfg, err := config.Load()
 		if err != nil {
 			return fmt.Errorf("failed to get config: %w", err)
 		}
-		authService := auth.NewService(cfg)
+		account, err := selectedAccount(cfg)
+		if err != nil {
+			return err
+		}
 
-		token, err := authService.GetToken()
+		token, source, err := account.GetTokenWithSource()
 		if err != nil {
 			return fmt.Errorf("failed to read token: %w", err)
 		}
 
-		fmt.Println("Token information:")
-		fmt.Printf("Access Token: %s\n", token.AccessToken)
-		fmt.Printf("Refresh Token: %s\n", token.RefreshToken)
+		info := tokenInfo{
+			Account:      account.Name,
+			Source:       source,
+			Region:       account.Region(),
+			AccessToken:  maskSecret(token.AccessToken),
+			RefreshToken: maskSecret(token.RefreshToken),
+		}
+		if reveal {
+			info.AccessToken = token.AccessToken
+			info.RefreshToken = token.RefreshToken
+		}
+		if info.ProfileArn, err = account.ProfileFor(token); err != nil {
+			info.ProfileError = err.Error()
+		}
 		if token.ExpiresAt != "" {
-			fmt.Printf("Expires At: %s\n", token.ExpiresAt)
+			if expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt); err == nil {
+				expiresIn := int64(time.Until(expiresAt).Seconds())
+				info.ExpiresAt = &expiresAt
+				info.ExpiresInSeconds = &expiresIn
+				info.Expired = expiresIn <= 0
+			}
+		}
+
+		if readJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+
+		fmt.Println("Token information:")
+		fmt.Printf("Account:       %s\n", info.Account)
+		fmt.Printf("Source:        %s\n", info.Source)
+		fmt.Printf("Region:        %s\n", info.Region)
+		if info.ProfileError != "" {
+			fmt.Printf("Profile ARN:   invalid: %s\n", info.ProfileError)
+		} else {
+			fmt.Printf("Profile ARN:   %s\n", info.ProfileArn)
+		}
+		fmt.Printf("Access Token:  %s\n", info.AccessToken)
+		fmt.Printf("Refresh Token: %s\n", info.RefreshToken)
+		switch {
+		case info.ExpiresAt != nil:
+			fmt.Printf("Expires At:    %s (%s)\n", info.ExpiresAt.Local().Format("2006-01-02 15:04:05 MST"), describeExpiry(*info.ExpiresInSeconds))
+		case token.ExpiresAt != "":
+			fmt.Printf("Expires At:    %s\n", token.ExpiresAt)
 		}
 
 		return nil
 	},
 }
+
+func init() {
+	readCmd.Flags().BoolVar(&reveal, "reveal", false, "Show the full access and refresh tokens")
+	readCmd.Flags().BoolVar(&readJSON, "json", false, "Print the token information as JSON")
+}
+
+// maskSecret keeps just enough of a token to tell tokens apart.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) <= 12 {
+		return "********"
+	}
+	return fmt.Sprintf("%s…%s (%d chars)", secret[:6], secret[len(secret)-4:], len(secret))
+}
+
+func describeExpiry(seconds int64) string {
+	d := (time.Duration(seconds) * time.Second).Round(time.Second)
+	if d <= 0 {
+		return fmt.Sprintf("expired %s ago", -d)
+	}
+	return fmt.Sprintf("expires in %s", d)
+}
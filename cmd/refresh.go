@@ -11,14 +11,22 @@ import (
 var refreshCmd = &cobra.Command{
 	Use:   "refresh",
 	Short: "Refresh the access token",
-	Long:  "Refresh the Kiro access token using the stored refresh token.",
+	Long:  "Refresh the Kiro access token using the stored refresh token. Without --account, every configured account is refreshed.",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Default()
+		cfg, err := config.Load()
 		if err != nil {
 			return fmt.Errorf("failed to get config: %w", err)
 		}
-		authService := auth.NewService(cfg)
-		
+
+		if accountName == "" && len(cfg.AccountList()) > 1 {
+			return refreshAllAccounts(cfg)
+		}
+
+		authService, err := selectedAccount(cfg)
+		if err != nil {
+			return err
+		}
+
 		if err := authService.RefreshToken(); err != nil {
 			return fmt.Errorf("failed to refresh token: %w", err)
 		}
@@ -31,8 +39,26 @@ var refreshCmd = &cobra.Command{
 			return fmt.Errorf("failed to read refreshed token: %w", err)
 		}
 		
-		fmt.Printf("New Access Token: %s\n", token.AccessToken)
+		fmt.Printf("New Access Token: %s\n", maskSecret(token.AccessToken))
 		
 		return nil
 	},
-}
\ No newline at end of file
+}
+
+// refreshAllAccounts refreshes every account in the pool and fails only if
+// none of them could be refreshed.
+func refreshAllAccounts(cfg *config.Config) error {
+	refreshed := 0
+	for _, account := range auth.NewPool(cfg).Accounts() {
+		if err := account.RefreshToken(); err != nil {
+			fmt.Printf("Account %s: refresh failed: %v\n", account.Name, err)
+			continue
+		}
+		fmt.Printf("Account %s: token refreshed.\n", account.Name)
+		refreshed++
+	}
+	if refreshed == 0 {
+		return fmt.Errorf("failed to refresh any account")
+	}
+	return nil
+}
@@ -1,35 +1,65 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/auth"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/version"
 )
 
+var accountName string
+
 var rootCmd = &cobra.Command{
 	Use:   "kiro2cc",
 	Short: "Kiro to Claude Code bridge",
 	Long: `A CLI tool that manages Kiro authentication tokens and provides 
 an Anthropic API proxy service. The tool acts as a bridge between 
 Anthropic API requests and AWS CodeWhisperer.`,
+	Version: version.Version,
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
 }
 
+// errSilentFailure makes the process exit with status 1 without printing
+// an error, for commands whose output already says what went wrong.
+var errSilentFailure = errors.New("command failed")
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if !errors.Is(err, errSilentFailure) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
 		os.Exit(1)
 	}
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&accountName, "account", "", "Name of the account to use (defaults to the first configured account)")
+
 	rootCmd.AddCommand(readCmd)
 	rootCmd.AddCommand(refreshCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(claudeCmd)
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(usageCmd)
+	rootCmd.AddCommand(profileCmd)
+	rootCmd.AddCommand(keysCmd)
+}
+
+// selectedAccount returns the account chosen with --account, or the first
+// configured account.
+func selectedAccount(cfg *config.Config) (*auth.Account, error) {
+	pool := auth.NewPool(cfg)
+	if accountName == "" {
+		return pool.Accounts()[0], nil
+	}
+	return pool.Get(accountName)
 }
@@ -1,27 +1,42 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/apikeys"
 	"github.com/shyn/kiro2cc/internal/auth"
 	"github.com/shyn/kiro2cc/internal/client"
 	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/logfile"
+	"github.com/shyn/kiro2cc/internal/logging"
 	"github.com/shyn/kiro2cc/internal/proxy"
+	"github.com/shyn/kiro2cc/internal/tracing"
+	"github.com/shyn/kiro2cc/internal/traffic"
 	"github.com/shyn/kiro2cc/internal/translator"
+	"github.com/shyn/kiro2cc/internal/usage"
+	"github.com/spf13/cobra"
 )
 
 var (
-	port   string
-	daemon bool
-	stop   bool
+	port     string
+	listen   []string
+	daemon   bool
+	stop     bool
+	logFile  string
+	logLevel string
 )
 
 var serverCmd = &cobra.Command{
@@ -29,17 +44,26 @@ var serverCmd = &cobra.Command{
 	Short: "Manage the Anthropic API proxy server",
 	Long:  "Start, stop, or manage the HTTP proxy server that translates Anthropic API requests.",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Default()
+		cfg, err := config.Load()
 		if err != nil {
 			return fmt.Errorf("failed to get config: %w", err)
 		}
 
-		if port != "" {
+		if cmd.Flags().Changed("port") {
 			cfg.Server.Port = port
+			cfg.Server.Listen = nil
+		}
+		if len(listen) > 0 {
+			for _, addr := range listen {
+				if err := config.ValidateListenAddress(addr); err != nil {
+					return err
+				}
+			}
+			cfg.Server.Listen = listen
 		}
 
 		if stop {
-			return stopServer(cfg)
+			return stopServer(cfg, defaultStopTimeout(cfg))
 		}
 
 		if daemon {
@@ -51,38 +75,121 @@ var serverCmd = &cobra.Command{
 }
 
 func init() {
-	serverCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to run the server on")
+	serverCmd.Flags().StringVarP(&port, "port", "p", "8080", "Port to listen on at 127.0.0.1")
+	serverCmd.Flags().StringArrayVar(&listen, "listen", nil, "Address to listen on, host:port or unix:///path/to.sock (repeatable)")
 	serverCmd.Flags().BoolVarP(&daemon, "daemon", "d", false, "Run the server in the background")
 	serverCmd.Flags().BoolVar(&stop, "stop", false, "Stop the running server")
+	serverCmd.Flags().StringVar(&logFile, "log-file", "", "Write the log to this file, rotating it as configured under \"log\"")
+	serverCmd.Flags().StringVar(&logLevel, "log-level", "", "Log level: debug, info, warn or error (default from config, info)")
 }
 
 func startServer(cfg *config.Config) error {
-	logger := proxy.NewSimpleLogger()
-	authService := auth.NewService(cfg)
+	var out io.Writer = os.Stdout
+	if logFile != "" {
+		w, err := logfile.Open(logFile, logfile.Options{
+			MaxSize:     int64(cfg.Log.MaxSizeMB) << 20,
+			RotateEvery: cfg.Log.RotateEvery.Duration,
+			MaxAge:      cfg.Log.MaxAge.Duration,
+			MaxBackups:  cfg.Log.MaxBackups,
+			Compress:    cfg.Log.Compress,
+		})
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		out = w
+	}
+	if logLevel != "" {
+		cfg.Log.Level = logLevel
+	}
+	logger, err := logging.New(out, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	// The default logger also receives the translator's and parser's
+	// records, and anything still using the log package.
+	slog.SetDefault(logger)
+
+	for _, acct := range cfg.AccountList() {
+		if !slices.Contains(config.KnownRegions, acct.Region) {
+			logger.Warn("Account region is not one Kiro is known to serve", "account", acct.Name, "region", acct.Region, "known", config.KnownRegions)
+		}
+	}
+
+	accounts := auth.NewPool(cfg)
 	translatorService := translator.NewService(cfg)
 	cwClient := client.NewCodeWhispererClient(cfg)
 
-	handlers := proxy.NewHandlers(authService, translatorService, cwClient, logger)
-	server := proxy.NewServer(cfg, handlers, logger)
+	recorder, err := traffic.NewRecorder(cfg.Traffic)
+	if err != nil {
+		return err
+	}
+	if recorder != nil {
+		logger.Warn("Traffic logging is enabled, request and response bodies are written to disk", "dir", cfg.Traffic.Dir)
+	}
+
+	tracer := tracing.NewTracer(cfg.Tracing, logger)
+	if tracer != nil {
+		logger.Info("Exporting traces", "endpoint", cfg.Tracing.Endpoint, "sample_ratio", cfg.Tracing.SampleRatio)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tracer.Shutdown(ctx)
+		}()
+	}
+
+	handlers := proxy.NewHandlers(cfg, accounts, translatorService, cwClient, recorder, tracer, logger)
+	keys := apikeys.NewStore(cfg.Server.KeysFilePath, cfg.Server.APIKeys)
+	var ledger *usage.Ledger
+	if cfg.Usage.Enabled {
+		if ledger, err = usage.Open(cfg.Usage.File); err != nil {
+			return err
+		}
+		defer ledger.Close()
+	}
+	server := proxy.NewServer(cfg, handlers, keys, ledger, logger)
 
-	fmt.Printf("Starting server on port %s...\n", cfg.Server.Port)
+	fmt.Printf("Starting server on %s...\n", strings.Join(cfg.ListenAddresses(), ", "))
+	defer removeOwnPIDFile(cfg.Server.PIDFilePath)
 	return server.Start()
 }
 
 func startDaemon(cfg *config.Config) error {
-	if isRunning(cfg.Server.PIDFilePath) {
-		fmt.Println("Server is already running.")
+	if pid, ok := runningPID(cfg.Server.PIDFilePath); ok {
+		fmt.Printf("Server is already running with PID %d.\n", pid)
 		return nil
 	}
+	if serverHealthy(cfg) {
+		return fmt.Errorf("a server is already answering on %s", cfg.ListenAddresses()[0])
+	}
 
 	executable, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("could not find executable path: %w", err)
 	}
 
-	cmd := exec.Command(executable, "server", "--port", cfg.Server.Port)
-	cmd.Stdout = nil
-	cmd.Stderr = nil
+	// The server writes its log itself so that it can rotate it. Anything
+	// else it prints, such as startup errors and panics, lands next to it.
+	outputPath := daemonOutputPath(cfg)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open daemon output file: %w", err)
+	}
+	defer output.Close()
+
+	args := []string{"server", "--log-file", cfg.Log.File}
+	for _, addr := range cfg.ListenAddresses() {
+		args = append(args, "--listen", addr)
+	}
+	if logLevel != "" {
+		args = append(args, "--log-level", logLevel)
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setsid: true,
 	}
@@ -97,15 +204,28 @@ func startDaemon(cfg *config.Config) error {
 
 	pid := cmd.Process.Pid
 	if err := ioutil.WriteFile(cfg.Server.PIDFilePath, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		cmd.Process.Kill()
 		return fmt.Errorf("failed to write PID file: %w", err)
 	}
 
-	fmt.Printf("Server started in background with PID: %d on port %s\n", pid, cfg.Server.Port)
-	time.Sleep(1 * time.Second)
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	if err := waitForReady(cfg, exited, daemonReadyTimeout); err != nil {
+		cmd.Process.Kill()
+		os.Remove(cfg.Server.PIDFilePath)
+		for _, line := range tailFile(outputPath, 0, 20) {
+			fmt.Fprintln(os.Stderr, line)
+		}
+		fmt.Fprintf(os.Stderr, "See %s for the server log.\n", cfg.Log.File)
+		return err
+	}
+
+	fmt.Printf("Server started in background with PID: %d on %s\n", pid, strings.Join(cfg.ListenAddresses(), ", "))
+	fmt.Printf("Logs are written to %s, view them with 'kiro2cc logs'\n", cfg.Log.File)
 	return nil
 }
 
-func stopServer(cfg *config.Config) error {
+func stopServer(cfg *config.Config, timeout time.Duration) error {
 	pid, err := readPIDFile(cfg.Server.PIDFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -115,6 +235,12 @@ func stopServer(cfg *config.Config) error {
 		return fmt.Errorf("failed to read PID file: %w", err)
 	}
 
+	if !isServerProcess(pid) {
+		fmt.Printf("PID %d is not a running kiro2cc server, cleaning up stale PID file.\n", pid)
+		os.Remove(cfg.Server.PIDFilePath)
+		return nil
+	}
+
 	process, err := os.FindProcess(pid)
 	if err != nil {
 		fmt.Println("Could not find process, cleaning up stale PID file.")
@@ -123,7 +249,7 @@ func stopServer(cfg *config.Config) error {
 	}
 
 	if err := process.Signal(syscall.SIGTERM); err != nil {
-		if err == syscall.ESRCH {
+		if err == syscall.ESRCH || err == os.ErrProcessDone {
 			fmt.Println("Process not found, cleaning up stale PID file.")
 			os.Remove(cfg.Server.PIDFilePath)
 			return nil
@@ -131,22 +257,57 @@ func stopServer(cfg *config.Config) error {
 		return fmt.Errorf("failed to send SIGTERM to process %d: %w", pid, err)
 	}
 
+	fmt.Printf("Waiting up to %v for server with PID %d to finish active requests...\n", timeout, pid)
+	if !waitForExit(process, timeout) {
+		fmt.Printf("Server did not exit in time, sending SIGKILL.\n")
+		if err := process.Signal(syscall.SIGKILL); err != nil && err != syscall.ESRCH && err != os.ErrProcessDone {
+			return fmt.Errorf("failed to send SIGKILL to process %d: %w", pid, err)
+		}
+		if !waitForExit(process, 5*time.Second) {
+			return fmt.Errorf("server with PID %d is still running after SIGKILL", pid)
+		}
+	}
+
 	os.Remove(cfg.Server.PIDFilePath)
 	fmt.Printf("Server with PID %d has been stopped.\n", pid)
 	return nil
 }
 
-func isRunning(pidFile string) bool {
-	pid, err := readPIDFile(pidFile)
-	if err != nil {
-		return false
+// waitForExit polls until the process is gone or the timeout passes.
+func waitForExit(process *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := process.Signal(syscall.Signal(0)); err != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	process, err := os.FindProcess(pid)
+}
+
+// daemonOutputPath is where a daemon's stdout and stderr go.
+func daemonOutputPath(cfg *config.Config) string {
+	return filepath.Join(filepath.Dir(cfg.Log.File), "daemon.out")
+}
+
+// removeOwnPIDFile deletes the PID file when it names this process, so a
+// daemon that exits on its own does not leave a stale file behind.
+func removeOwnPIDFile(pidFile string) {
+	if pid, err := readPIDFile(pidFile); err == nil && pid == os.Getpid() {
+		os.Remove(pidFile)
+	}
+}
+
+// runningPID returns the PID from the PID file if it names a running
+// kiro2cc server.
+func runningPID(pidFile string) (int, bool) {
+	pid, err := readPIDFile(pidFile)
 	if err != nil {
-		return false
+		return 0, false
 	}
-	err = process.Signal(syscall.Signal(0))
-	return err == nil
+	return pid, isServerProcess(pid)
 }
 
 func readPIDFile(pidFile string) (int, error) {
@@ -154,9 +315,28 @@ func readPIDFile(pidFile string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	pid, err := strconv.Atoi(string(data))
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
 	if err != nil {
 		return 0, fmt.Errorf("invalid PID in PID file: %w", err)
 	}
 	return pid, nil
 }
+
+// proxyBaseURL returns the URL local clients should use to reach the
+// server, based on its first TCP listener.
+func proxyBaseURL(cfg *config.Config) (string, error) {
+	for _, addr := range cfg.ListenAddresses() {
+		if _, ok := config.UnixSocketPath(addr); ok {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		return "http://" + net.JoinHostPort(host, port), nil
+	}
+	return "", fmt.Errorf("the server only listens on unix sockets, add a host:port listen address for HTTP clients")
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/proxy"
+)
+
+var statusJSON bool
+
+// serverState is what `kiro2cc status` reports.
+type serverState struct {
+	Running bool `json:"running"`
+	// PID is the daemon's PID from the PID file, or the server's own PID
+	// when it was started in the foreground.
+	PID         int           `json:"pid,omitempty"`
+	Status      *proxy.Status `json:"status,omitempty"`
+	StatusError string        `json:"statusError,omitempty"`
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of the kiro2cc server",
+	Long: `Shows whether the kiro2cc server is running, and its PID, uptime, listen
+addresses, version, token expiry and request counters. Exits with an
+error if the server is not running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		state := serverState{}
+		pid, daemonRunning := runningPID(cfg.Server.PIDFilePath)
+		if daemonRunning {
+			state.PID = pid
+		}
+		// A server started in the foreground has no PID file but still
+		// answers on its listen address.
+		if daemonRunning || serverHealthy(cfg) {
+			state.Running = true
+			if state.Status, err = fetchStatus(cfg); err != nil {
+				state.StatusError = err.Error()
+			} else if !daemonRunning {
+				state.PID = state.Status.PID
+			}
+		}
+
+		if statusJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(state); err != nil {
+				return err
+			}
+		} else {
+			printServerState(state)
+		}
+
+		if !state.Running {
+			// Like `systemctl status`, exit non-zero for scripts, but the
+			// output above already says why.
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return errSilentFailure
+		}
+		return nil
+	},
+}
+
+func init() {
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
+}
+
+func printServerState(state serverState) {
+	if !state.Running {
+		fmt.Println("Server:    not running")
+		return
+	}
+
+	fmt.Printf("Server:    running (PID %d)\n", state.PID)
+	if state.Status == nil {
+		fmt.Printf("Status:    unavailable: %s\n", state.StatusError)
+		return
+	}
+
+	status := state.Status
+	uptime := (time.Duration(status.UptimeSeconds) * time.Second).String()
+	fmt.Printf("Version:   %s\n", status.Version)
+	fmt.Printf("Uptime:    %s (since %s)\n", uptime, status.StartedAt.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Listen:    %s\n", strings.Join(status.Listen, ", "))
+	fmt.Printf("Requests:  %d total, %d active, %d errors\n", status.Requests.Total, status.Requests.Active, status.Requests.Errors)
+	if q := status.Queue; q != nil {
+		fmt.Printf("Upstream:  %d/%d in flight, %d queued\n", q.InFlight, q.MaxInFlight, q.Waiting)
+	}
+	fmt.Println("Accounts:")
+	for _, acct := range status.Accounts {
+		token := "token expiry unknown"
+		switch {
+		case acct.TokenError != "":
+			token = "token unavailable: " + acct.TokenError
+		case acct.TokenExpiresAt != nil:
+			token = "token " + describeExpiry(int64(time.Until(*acct.TokenExpiresAt).Seconds()))
+		}
+		if acct.ThrottledUntil != nil {
+			token += fmt.Sprintf(", throttled until %s", acct.ThrottledUntil.Local().Format("15:04:05"))
+		}
+		fmt.Printf("  %-12s %-14s %s\n", acct.Name, acct.Region, token)
+	}
+}
@@ -1,23 +1,40 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/shyn/kiro2cc/internal/config"
 )
 
+var stopTimeout time.Duration
+
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Stop the kiro2cc background server",
-	Long:  "Finds and stops the kiro2cc server process that is running in the background.",
+	Long: `Finds and stops the kiro2cc server process that is running in the background.
+The server gets to finish active requests; if it has not exited when the
+timeout passes, it is killed.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.Default()
+		cfg, err := config.Load()
 		if err != nil {
 			return err
 		}
-		return stopServer(cfg)
+		timeout := stopTimeout
+		if !cmd.Flags().Changed("timeout") {
+			timeout = defaultStopTimeout(cfg)
+		}
+		return stopServer(cfg, timeout)
 	},
 }
 
 func init() {
 	// Command is added in root.go
+	stopCmd.Flags().DurationVar(&stopTimeout, "timeout", 0, "How long to wait for the server to exit before killing it (default: grace period + 5s)")
+}
+
+// defaultStopTimeout leaves the server its whole grace period plus a
+// little time to exit.
+func defaultStopTimeout(cfg *config.Config) time.Duration {
+	return cfg.Server.ShutdownGracePeriod.Duration + 5*time.Second
 }
\ No newline at end of file
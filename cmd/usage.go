@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/usage"
+)
+
+var (
+	usageSince  string
+	usageBy     string
+	usageFormat string
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Report usage from the request ledger",
+	Long: `Aggregates the usage ledger by day, model, API key or project.
+--since accepts a duration such as 7d or 12h, or a time such as
+"2006-01-02". The project is the directory kiro2cc claude was run in.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("failed to get config: %w", err)
+		}
+
+		by, err := usage.ParseGroupBy(usageBy)
+		if err != nil {
+			return err
+		}
+		var since time.Time
+		if usageSince != "" {
+			if since, err = parseSince(usageSince, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		records, err := usage.Read(cfg.Usage.File, since)
+		if err != nil {
+			return fmt.Errorf("failed to read usage ledger: %w", err)
+		}
+		rows := usage.Aggregate(records, by, time.Local)
+
+		switch usageFormat {
+		case "table":
+			return printUsageTable(os.Stdout, rows, by, keyNames(cfg))
+		case "csv":
+			return printUsageCSV(os.Stdout, rows, by)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(rows)
+		default:
+			return fmt.Errorf("unknown format %q, use table, csv or json", usageFormat)
+		}
+	},
+}
+
+func init() {
+	usageCmd.Flags().StringVar(&usageSince, "since", "", "Only count requests made since this time or for this long")
+	usageCmd.Flags().StringVar(&usageBy, "by", "day,model,key", "Comma-separated dimensions to group by: day, model, key, project")
+	usageCmd.Flags().StringVar(&usageFormat, "format", "table", "Output format: table, csv or json")
+}
+
+// keyNames maps API key IDs to their names, for display.
+func keyNames(cfg *config.Config) map[string]string {
+	names := make(map[string]string)
+	keys, err := keyStore(cfg).List()
+	if err != nil {
+		return names
+	}
+	for _, key := range keys {
+		names[key.ID] = key.Name
+	}
+	return names
+}
+
+// usageDimensions returns the header and value of each grouped dimension.
+func usageDimensions(row usage.Row, by []string) (headers, values []string) {
+	for _, dim := range by {
+		switch dim {
+		case usage.ByDay:
+			headers, values = append(headers, "DAY"), append(values, row.Day)
+		case usage.ByModel:
+			headers, values = append(headers, "MODEL"), append(values, row.Model)
+		case usage.ByKey:
+			headers, values = append(headers, "KEY"), append(values, row.APIKey)
+		case usage.ByProject:
+			headers, values = append(headers, "PROJECT"), append(values, row.Project)
+		}
+	}
+	return headers, values
+}
+
+func printUsageTable(w io.Writer, rows []usage.Row, by []string, names map[string]string) error {
+	if len(rows) == 0 {
+		fmt.Fprintln(w, "No usage recorded.")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	headers, _ := usageDimensions(usage.Row{}, by)
+	for _, h := range append(headers, "REQUESTS", "ERRORS", "INPUT", "OUTPUT", "AVG LATENCY") {
+		fmt.Fprintf(tw, "%s\t", h)
+	}
+	fmt.Fprintln(tw)
+
+	var total usage.Row
+	for _, row := range rows {
+		if name, ok := names[row.APIKey]; ok {
+			row.APIKey = fmt.Sprintf("%s (%s)", name, row.APIKey)
+		}
+		_, values := usageDimensions(row, by)
+		for _, v := range values {
+			if v == "" {
+				v = "-"
+			}
+			fmt.Fprintf(tw, "%s\t", v)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t\n", row.Requests, row.Errors, row.InputTokens, row.OutputTokens, time.Duration(row.AvgLatencyMS)*time.Millisecond)
+
+		total.Requests += row.Requests
+		total.Errors += row.Errors
+		total.InputTokens += row.InputTokens
+		total.OutputTokens += row.OutputTokens
+		total.AvgLatencyMS += row.AvgLatencyMS * int64(row.Requests)
+	}
+	if len(rows) > 1 {
+		for range by {
+			fmt.Fprint(tw, "\t")
+		}
+		avg := time.Duration(total.AvgLatencyMS/int64(total.Requests)) * time.Millisecond
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%s\t\n", total.Requests, total.Errors, total.InputTokens, total.OutputTokens, avg)
+	}
+	return tw.Flush()
+}
+
+func printUsageCSV(w io.Writer, rows []usage.Row, by []string) error {
+	cw := csv.NewWriter(w)
+	var header []string
+	for _, dim := range by {
+		header = append(header, dim)
+	}
+	cw.Write(append(header, "requests", "errors", "input_tokens", "output_tokens", "avg_latency_ms"))
+	for _, row := range rows {
+		_, values := usageDimensions(row, by)
+		cw.Write(append(values,
+			strconv.Itoa(row.Requests),
+			strconv.Itoa(row.Errors),
+			strconv.Itoa(row.InputTokens),
+			strconv.Itoa(row.OutputTokens),
+			strconv.FormatInt(row.AvgLatencyMS, 10)))
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -2,7 +2,10 @@ module github.com/shyn/kiro2cc
 
 go 1.23.3
 
-require github.com/spf13/cobra v1.8.1
+require (
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/spf13/cobra v1.8.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
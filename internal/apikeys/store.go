@@ -0,0 +1,269 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPrefix starts every key issued by kiro2cc, so leaked keys are easy
+// to recognize and redact.
+const KeyPrefix = "sk-kiro2cc-"
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+// Key is a local API key. Only a hash of the secret is stored.
+type Key struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+type keyFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Store manages the keys file and authenticates request keys. The file is
+// re-read whenever it changes, so keys created or revoked with the CLI
+// take effect in a running server.
+type Store struct {
+	path   string
+	static []Key
+
+	mu      sync.Mutex
+	keys    []Key
+	modTime time.Time
+}
+
+// NewStore opens the keys file at path. staticKeys are extra keys taken
+// verbatim from the config file.
+func NewStore(path string, staticKeys []string) *Store {
+	s := &Store{path: path}
+	for i, secret := range staticKeys {
+		s.static = append(s.static, Key{
+			ID:     fmt.Sprintf("config-%d", i+1),
+			Name:   fmt.Sprintf("config key #%d", i+1),
+			Prefix: displayPrefix(secret),
+			Hash:   hashSecret(secret),
+		})
+	}
+	return s
+}
+
+// List returns the keys from the keys file, including revoked ones.
+func (s *Store) List() ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return append([]Key(nil), s.keys...), nil
+}
+
+// Create issues a new key and returns it together with its secret, which
+// is not recoverable afterwards.
+func (s *Store) Create(name string) (Key, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return Key{}, "", err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret = KeyPrefix + secret
+	id, err := randomHex(4)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	key := Key{
+		ID:        "key_" + id,
+		Name:      name,
+		Prefix:    displayPrefix(secret),
+		Hash:      hashSecret(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.save(append(s.keys, key)); err != nil {
+		return Key{}, "", err
+	}
+	return key, secret, nil
+}
+
+// Revoke disables the key with the given ID, or every active key with
+// the given name.
+func (s *Store) Revoke(idOrName string) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	keys := append([]Key(nil), s.keys...)
+	var revoked []Key
+	for i := range keys {
+		if keys[i].Revoked() || (keys[i].ID != idOrName && keys[i].Name != idOrName) {
+			continue
+		}
+		keys[i].RevokedAt = &now
+		revoked = append(revoked, keys[i])
+	}
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("no active key with ID or name %q", idOrName)
+	}
+	return revoked, s.save(keys)
+}
+
+// Authenticate returns the active key matching secret.
+func (s *Store) Authenticate(secret string) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	hash := hashSecret(secret)
+	for _, keys := range [][]Key{s.static, s.keys} {
+		for i := range keys {
+			if keys[i].Revoked() {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(keys[i].Hash), []byte(hash)) == 1 {
+				key := keys[i]
+				return &key, nil
+			}
+		}
+	}
+	return nil, ErrInvalidKey
+}
+
+// HasKeys reports whether any active key exists.
+func (s *Store) HasKeys() (bool, error) {
+	keys, err := s.List()
+	if err != nil {
+		return false, err
+	}
+	if len(s.static) > 0 {
+		return true, nil
+	}
+	for _, key := range keys {
+		if !key.Revoked() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys, s.modTime = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat keys file: %w", err)
+	}
+	if info.ModTime().Equal(s.modTime) && s.keys != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read keys file: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse keys file %s: %w", s.path, err)
+	}
+	s.keys = file.Keys
+	if s.keys == nil {
+		s.keys = []Key{}
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *Store) save(keys []Key) error {
+	data, err := json.MarshalIndent(keyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write keys file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to write keys file: %w", err)
+	}
+
+	s.keys = keys
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func displayPrefix(secret string) string {
+	n := len(KeyPrefix) + 4
+	if !strings.HasPrefix(secret, KeyPrefix) {
+		n = 4
+	}
+	if len(secret) < n {
+		return ""
+	}
+	return secret[:n] + "…"
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the authenticated key.
+func NewContext(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext returns the authenticated key of the request, if any.
+func FromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(contextKey{}).(*Key)
+	return key
+}
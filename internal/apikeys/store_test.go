@@ -0,0 +1,125 @@
+package apikeys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateStoresOnlyTheHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store := NewStore(path, nil)
+	key, secret, err := store.Create("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(secret, KeyPrefix) || !strings.HasPrefix(key.Prefix, KeyPrefix) {
+		t.Fatalf("secret %q or display prefix %q lacks %s", secret, key.Prefix, KeyPrefix)
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if key.Hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Hash = %s, want the SHA-256 of the secret", key.Hash)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Fatal("keys file contains the secret")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("keys file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "keys.json"), []string{"static-secret"})
+	key, secret, err := store.Create("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Authenticate(secret)
+	if err != nil || got.ID != key.ID {
+		t.Fatalf("Authenticate(secret) = %v, %v, want key %s", got, err, key.ID)
+	}
+	if got, err := store.Authenticate("static-secret"); err != nil || got.ID != "config-1" {
+		t.Fatalf("Authenticate(static key) = %v, %v, want config-1", got, err)
+	}
+	for _, wrong := range []string{"", secret[:len(secret)-1], secret + "0", key.Hash} {
+		if _, err := store.Authenticate(wrong); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Authenticate(%q) = %v, want ErrInvalidKey", wrong, err)
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "keys.json"), nil)
+	first, firstSecret, _ := store.Create("ci")
+	_, secondSecret, _ := store.Create("ci")
+	other, otherSecret, _ := store.Create("laptop")
+
+	revoked, err := store.Revoke(other.ID)
+	if err != nil || len(revoked) != 1 || revoked[0].ID != other.ID || !revoked[0].Revoked() {
+		t.Fatalf("Revoke(ID) = %v, %v", revoked, err)
+	}
+	if _, err := store.Authenticate(otherSecret); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("revoked key authenticated: %v", err)
+	}
+
+	revoked, err = store.Revoke("ci")
+	if err != nil || len(revoked) != 2 || revoked[0].ID != first.ID {
+		t.Fatalf("Revoke(name) = %v, %v, want both ci keys", revoked, err)
+	}
+	for _, secret := range []string{firstSecret, secondSecret} {
+		if _, err := store.Authenticate(secret); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("revoked key authenticated: %v", err)
+		}
+	}
+
+	if _, err := store.Revoke("ci"); err == nil {
+		t.Fatal("revoking already revoked keys succeeded")
+	}
+	if ok, err := store.HasKeys(); ok || err != nil {
+		t.Fatalf("HasKeys() = %v, %v after revoking every key", ok, err)
+	}
+}
+
+func TestReloadWhenTheFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	server := NewStore(path, nil)
+	cli := NewStore(path, nil)
+
+	key, secret, err := cli.Create("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Authenticate(secret); err != nil {
+		t.Fatalf("key created by another store was not picked up: %v", err)
+	}
+
+	if _, err := cli.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is visible even where mtimes are coarse.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Authenticate(secret); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("key revoked by another store still authenticates: %v", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := server.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("List() after removing the file = %v, %v", keys, err)
+	}
+}
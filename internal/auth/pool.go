@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+// maxStickyEntries bounds the conversation-to-account map used by the
+// sticky policy; the least recently seen conversations are dropped first.
+const maxStickyEntries = 4096
+
+// Account is one named Kiro account in the pool.
+type Account struct {
+	Service
+
+	Name string
+	// ProfileArn pins the profile from the config file; when empty the
+	// profile selected on the token is used.
+	ProfileArn string
+
+	fallbackProfileArn string
+
+	lastUsed       time.Time
+	lastThrottled  time.Time
+	throttledUntil time.Time
+}
+
+// ProfileFor returns the profile ARN to send with requests made using
+// token: the pinned profile, then the one discovered for the token, then
+// the global default. It fails if the token and profile do not belong to
+// the account's region.
+func (a *Account) ProfileFor(token *types.TokenData) (string, error) {
+	profileArn := a.ProfileArn
+	if profileArn == "" && token != nil {
+		profileArn = token.ProfileArn
+	}
+	if profileArn == "" {
+		profileArn = a.fallbackProfileArn
+	}
+	if err := CheckRegion(a.Region(), token, profileArn); err != nil {
+		return "", err
+	}
+	return profileArn, nil
+}
+
+type stickyEntry struct {
+	account  string
+	lastSeen time.Time
+}
+
+// Pool selects among several accounts and tracks which of them upstream
+// is currently throttling.
+type Pool struct {
+	mu       sync.Mutex
+	accounts []*Account
+	policy   string
+	cooldown time.Duration
+	next     int
+	sticky   map[string]stickyEntry
+	now      func() time.Time
+}
+
+func NewPool(cfg *config.Config) *Pool {
+	accountConfigs := cfg.AccountList()
+	accounts := make([]*Account, 0, len(accountConfigs))
+	for _, acct := range accountConfigs {
+		account := &Account{
+			Service:    NewAccountService(cfg, acct),
+			Name:       acct.Name,
+			ProfileArn: acct.ProfileArn,
+		}
+		// The built-in profile only makes sense in its own region.
+		if config.RegionFromArn(cfg.CodeWhisperer.ProfileArn) == acct.Region {
+			account.fallbackProfileArn = cfg.CodeWhisperer.ProfileArn
+		}
+		accounts = append(accounts, account)
+	}
+	return newPool(accounts, cfg.Auth.SelectionPolicy, cfg.Auth.ThrottleCooldown.Duration)
+}
+
+func newPool(accounts []*Account, policy string, cooldown time.Duration) *Pool {
+	return &Pool{
+		accounts: accounts,
+		policy:   policy,
+		cooldown: cooldown,
+		sticky:   make(map[string]stickyEntry),
+		now:      time.Now,
+	}
+}
+
+// Accounts returns all accounts in configuration order.
+func (p *Pool) Accounts() []*Account {
+	return p.accounts
+}
+
+// Get returns the account with the given name.
+func (p *Pool) Get(name string) (*Account, error) {
+	for _, acct := range p.accounts {
+		if acct.Name == name {
+			return acct, nil
+		}
+	}
+	return nil, fmt.Errorf("account %q is not configured", name)
+}
+
+// Select picks the account that should serve the next request. key
+// identifies the conversation for the sticky policy, and accounts named in
+// exclude (those already tried for this request) are skipped. Throttled
+// accounts are only returned once every other candidate is throttled too.
+func (p *Pool) Select(key string, exclude map[string]bool) (*Account, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	var candidates []int
+	for i, acct := range p.accounts {
+		if !exclude[acct.Name] {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no accounts left to try")
+	}
+
+	available := make([]int, 0, len(candidates))
+	for _, i := range candidates {
+		if !now.Before(p.accounts[i].throttledUntil) {
+			available = append(available, i)
+		}
+	}
+
+	var chosen *Account
+	if len(available) == 0 {
+		// Everyone is throttled: use whoever recovers first.
+		chosen = p.accounts[candidates[0]]
+		for _, i := range candidates[1:] {
+			if p.accounts[i].throttledUntil.Before(chosen.throttledUntil) {
+				chosen = p.accounts[i]
+			}
+		}
+	} else {
+		switch p.policy {
+		case config.PolicyLeastThrottled:
+			chosen = p.leastThrottled(available)
+		case config.PolicySticky:
+			chosen = p.stickyFor(key, available, now)
+		default:
+			chosen = p.roundRobin(available)
+		}
+	}
+
+	chosen.lastUsed = now
+	return chosen, nil
+}
+
+func (p *Pool) roundRobin(available []int) *Account {
+	for n := 0; n < len(p.accounts); n++ {
+		i := (p.next + n) % len(p.accounts)
+		for _, j := range available {
+			if i == j {
+				p.next = i + 1
+				return p.accounts[i]
+			}
+		}
+	}
+	return p.accounts[available[0]]
+}
+
+func (p *Pool) leastThrottled(available []int) *Account {
+	chosen := p.accounts[available[0]]
+	for _, i := range available[1:] {
+		acct := p.accounts[i]
+		switch {
+		case acct.lastThrottled.Before(chosen.lastThrottled):
+			chosen = acct
+		case acct.lastThrottled.Equal(chosen.lastThrottled) && acct.lastUsed.Before(chosen.lastUsed):
+			chosen = acct
+		}
+	}
+	return chosen
+}
+
+func (p *Pool) stickyFor(key string, available []int, now time.Time) *Account {
+	if key == "" {
+		return p.roundRobin(available)
+	}
+
+	if entry, ok := p.sticky[key]; ok {
+		for _, i := range available {
+			if p.accounts[i].Name == entry.account {
+				p.sticky[key] = stickyEntry{account: entry.account, lastSeen: now}
+				return p.accounts[i]
+			}
+		}
+	}
+
+	chosen := p.roundRobin(available)
+	if len(p.sticky) >= maxStickyEntries {
+		p.evictOldestSticky()
+	}
+	p.sticky[key] = stickyEntry{account: chosen.Name, lastSeen: now}
+	return chosen
+}
+
+func (p *Pool) evictOldestSticky() {
+	var oldestKey string
+	var oldest time.Time
+	for k, entry := range p.sticky {
+		if oldestKey == "" || entry.lastSeen.Before(oldest) {
+			oldestKey, oldest = k, entry.lastSeen
+		}
+	}
+	delete(p.sticky, oldestKey)
+}
+
+// MarkThrottled takes an account out of rotation after upstream rejected
+// it for throttling or quota exhaustion. retryAfter overrides the default
+// cooldown when upstream supplied one.
+func (p *Pool) MarkThrottled(acct *Account, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if retryAfter <= 0 {
+		retryAfter = p.cooldown
+	}
+	now := p.now()
+	acct.lastThrottled = now
+	acct.throttledUntil = now.Add(retryAfter)
+}
+
+// ThrottledUntil returns when the account comes back into rotation, or
+// the zero time if it was never throttled.
+func (p *Pool) ThrottledUntil(acct *Account) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return acct.throttledUntil
+}
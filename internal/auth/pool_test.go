@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+func testPool(policy string, names ...string) *Pool {
+	accounts := make([]*Account, 0, len(names))
+	for _, name := range names {
+		accounts = append(accounts, &Account{Name: name})
+	}
+	return newPool(accounts, policy, time.Minute)
+}
+
+func TestPoolRoundRobinSkipsThrottled(t *testing.T) {
+	p := testPool(config.PolicyRoundRobin, "a", "b", "c")
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		acct, err := p.Select("", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, acct.Name)
+	}
+	if want := "a b c a"; strings.Join(got, " ") != want {
+		t.Fatalf("rotation = %q, want %q", strings.Join(got, " "), want)
+	}
+
+	b, _ := p.Get("b")
+	p.MarkThrottled(b, 0)
+	for i := 0; i < 3; i++ {
+		acct, _ := p.Select("", nil)
+		if acct.Name == "b" {
+			t.Fatal("throttled account selected while others are available")
+		}
+	}
+}
+
+func TestPoolFailoverExhaustsAccounts(t *testing.T) {
+	p := testPool(config.PolicyRoundRobin, "a", "b")
+	tried := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		acct, err := p.Select("", tried)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tried[acct.Name] = true
+	}
+	if _, err := p.Select("", tried); err == nil {
+		t.Fatal("expected an error once every account was tried")
+	}
+}
+
+func TestPoolAllThrottledPicksSoonestRecovery(t *testing.T) {
+	p := testPool(config.PolicyRoundRobin, "a", "b")
+	a, _ := p.Get("a")
+	b, _ := p.Get("b")
+	p.MarkThrottled(a, 10*time.Minute)
+	p.MarkThrottled(b, time.Minute)
+
+	acct, err := p.Select("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acct.Name != "b" {
+		t.Fatalf("selected %s, want b", acct.Name)
+	}
+}
+
+func TestPoolLeastThrottled(t *testing.T) {
+	p := testPool(config.PolicyLeastThrottled, "a", "b")
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+
+	a, _ := p.Get("a")
+	p.MarkThrottled(a, time.Second)
+	clock = clock.Add(2 * time.Second)
+
+	acct, _ := p.Select("", nil)
+	if acct.Name != "b" {
+		t.Fatalf("selected %s, want b (never throttled)", acct.Name)
+	}
+}
+
+func TestPoolSticky(t *testing.T) {
+	p := testPool(config.PolicySticky, "a", "b")
+
+	first, _ := p.Select("conv-1", nil)
+	other, _ := p.Select("conv-2", nil)
+	if first.Name == other.Name {
+		t.Fatal("new conversations should be spread across accounts")
+	}
+	again, _ := p.Select("conv-1", nil)
+	if again.Name != first.Name {
+		t.Fatalf("conversation moved from %s to %s", first.Name, again.Name)
+	}
+
+	p.MarkThrottled(first, 0)
+	moved, _ := p.Select("conv-1", nil)
+	if moved.Name == first.Name {
+		t.Fatal("sticky conversation should fail over when its account is throttled")
+	}
+}
@@ -3,25 +3,50 @@ package auth
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/shyn/kiro2cc/internal/client"
 	"github.com/shyn/kiro2cc/internal/config"
 	"github.com/shyn/kiro2cc/pkg/types"
 )
 
 type Service interface {
 	GetToken() (*types.TokenData, error)
+	// GetTokenWithSource also reports where the token was read from.
+	GetTokenWithSource() (*types.TokenData, string, error)
 	RefreshToken() error
+	// ForgetToken drops the cached token, so that the next GetToken reads
+	// the secret store again, e.g. after CodeWhisperer rejected it.
+	ForgetToken()
 	GetTokenFilePath() string
+	// DiscoverProfiles asks CodeWhisperer which profiles the token may use
+	// and caches the result alongside the token.
+	DiscoverProfiles() ([]types.Profile, error)
+	// UseProfile selects, by ARN or name, the profile sent with requests.
+	UseProfile(profile string) error
+	// Region is the AWS region the account's token and profile belong to.
+	Region() string
 }
 
 type service struct {
 	config     *config.Config
+	account    config.AccountConfig
 	httpClient HTTPClient
+	cwClient   client.CodeWhispererClient
+	store      SecretStore
+
+	// The token is kept in memory once loaded: reading a keyring costs a
+	// D-Bus round trip per request, and a locked one prompts the user.
+	mu           sync.Mutex
+	cached       *types.TokenData
+	cachedSource string
 }
 
 type HTTPClient interface {
@@ -29,27 +54,44 @@ type HTTPClient interface {
 	Post(url, contentType string, body io.Reader) (*http.Response, error)
 }
 
+// NewService returns the token service for the first configured account.
 func NewService(cfg *config.Config) Service {
+	return NewAccountService(cfg, cfg.AccountList()[0])
+}
+
+func NewServiceWithClient(cfg *config.Config, httpClient HTTPClient) Service {
 	return &service{
 		config:     cfg,
-		httpClient: &http.Client{},
+		account:    cfg.AccountList()[0],
+		httpClient: httpClient,
+		cwClient:   client.NewCodeWhispererClientWithHTTPClient(cfg, httpClient),
+		store:      NewSecretStore(cfg),
 	}
 }
 
-func NewServiceWithClient(cfg *config.Config, httpClient HTTPClient) Service {
+// NewAccountService returns the token service for a single named account.
+func NewAccountService(cfg *config.Config, account config.AccountConfig) Service {
 	return &service{
 		config:     cfg,
-		httpClient: httpClient,
+		account:    account,
+		httpClient: &http.Client{},
+		cwClient:   client.NewCodeWhispererClient(cfg),
+		store:      NewSecretStore(cfg),
 	}
 }
 
 func (s *service) GetTokenFilePath() string {
 	// New default path
-	newPath := s.config.Auth.TokenFilePath
+	newPath := s.account.TokenFilePath
 	if _, err := os.Stat(newPath); err == nil {
 		return newPath
 	}
 
+	// Only the default account may fall back to the token Kiro itself writes
+	if newPath != s.config.Auth.TokenFilePath {
+		return newPath
+	}
+
 	// Fallback to old path for backward compatibility
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -65,28 +107,65 @@ func (s *service) GetTokenFilePath() string {
 }
 
 func (s *service) GetToken() (*types.TokenData, error) {
-	tokenPath := s.GetTokenFilePath()
-	if tokenPath == "" {
-		return nil, fmt.Errorf("unable to determine token file path")
+	token, _, err := s.GetTokenWithSource()
+	return token, err
+}
+
+func (s *service) GetTokenWithSource() (*types.TokenData, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached == nil {
+		token, source, err := s.loadToken()
+		if err != nil {
+			return nil, "", err
+		}
+		s.cached, s.cachedSource = token, source
 	}
+	// Callers may modify the token before saving it.
+	token := *s.cached
+	return &token, s.cachedSource, nil
+}
 
-	data, err := os.ReadFile(tokenPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("token file not found at %s or legacy path. Please log in with Kiro first", tokenPath)
+func (s *service) ForgetToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cached = nil
+}
+
+// loadToken reads the token from the secret store, falling back to the
+// plaintext token files for tokens that were never saved by kiro2cc. It
+// also reports where the token was found.
+func (s *service) loadToken() (*types.TokenData, string, error) {
+	data, err := s.store.Load(s.account)
+	source := s.store.Location(s.account)
+	if errors.Is(err, ErrSecretNotFound) {
+		source = s.GetTokenFilePath()
+		if source == "" {
+			return nil, "", fmt.Errorf("unable to determine token file path")
+		}
+		data, err = os.ReadFile(source)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, "", fmt.Errorf("token file not found at %s or legacy path. Please log in with Kiro first", source)
+			}
+			return nil, "", fmt.Errorf("failed to read token file at %s: %w", source, err)
 		}
-		return nil, fmt.Errorf("failed to read token file at %s: %w", tokenPath, err)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to load token from %s: %w", s.store.Name(), err)
 	}
 
 	var token types.TokenData
 	if err := json.Unmarshal(data, &token); err != nil {
-		return nil, fmt.Errorf("failed to parse token file: %w", err)
+		return nil, "", fmt.Errorf("failed to parse token file: %w", err)
 	}
 
-	return &token, nil
+	return &token, source, nil
 }
 
 func (s *service) RefreshToken() error {
+	// Another kiro2cc process may have refreshed the token already, so
+	// start from the stored one rather than the cached one.
+	s.ForgetToken()
 	currentToken, err := s.GetToken()
 	if err != nil {
 		return fmt.Errorf("failed to get current token: %w", err)
@@ -102,7 +181,7 @@ func (s *service) RefreshToken() error {
 	}
 
 	resp, err := s.httpClient.Post(
-		s.config.Auth.RefreshTokenURL,
+		s.config.RefreshTokenURL(s.account.Region),
 		"application/json",
 		bytes.NewBuffer(reqBody),
 	)
@@ -121,24 +200,141 @@ func (s *service) RefreshToken() error {
 		return fmt.Errorf("failed to parse refresh response: %w", err)
 	}
 
-	newToken := types.TokenData(refreshResp)
+	newToken := types.TokenData{
+		AccessToken:  refreshResp.AccessToken,
+		RefreshToken: refreshResp.RefreshToken,
+		ExpiresAt:    refreshResp.ExpiresAt,
+		Region:       currentToken.Region,
+		ProfileArn:   currentToken.ProfileArn,
+		Profiles:     currentToken.Profiles,
+	}
+	if newToken.ProfileArn == "" {
+		newToken.ProfileArn = refreshResp.ProfileArn
+	}
+
+	// Profile discovery is best effort: on failure the previously cached
+	// profiles stay in place.
+	if profiles, err := s.cwClient.ListAvailableProfiles(newToken.AccessToken, s.account.Region); err == nil {
+		applyProfiles(&newToken, profiles)
+	}
+
 	return s.saveToken(&newToken)
 }
 
-func (s *service) saveToken(token *types.TokenData) error {
-	tokenPath := s.config.Auth.TokenFilePath // Always save to the new path
-	if tokenPath == "" {
-		return fmt.Errorf("unable to determine token file path")
+func (s *service) DiscoverProfiles() ([]types.Profile, error) {
+	token, err := s.GetToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckRegion(s.account.Region, token, ""); err != nil {
+		return nil, err
+	}
+
+	profiles, err := s.cwClient.ListAvailableProfiles(token.AccessToken, s.account.Region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list available profiles: %w", err)
 	}
 
+	applyProfiles(token, profiles)
+	if err := s.saveToken(token); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (s *service) UseProfile(profile string) error {
+	token, err := s.GetToken()
+	if err != nil {
+		return err
+	}
+
+	profiles := token.Profiles
+	if len(profiles) == 0 {
+		if profiles, err = s.DiscoverProfiles(); err != nil {
+			return err
+		}
+		if token, err = s.GetToken(); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range profiles {
+		if p.Arn == profile || p.ProfileName == profile {
+			if err := CheckRegion(s.account.Region, token, p.Arn); err != nil {
+				return err
+			}
+			token.ProfileArn = p.Arn
+			return s.saveToken(token)
+		}
+	}
+	return fmt.Errorf("profile %q is not available to this account, run 'kiro2cc profile list' to see the options", profile)
+}
+
+func (s *service) Region() string {
+	return s.account.Region
+}
+
+// CheckRegion reports an error if the token or the profile ARN belong to a
+// different region than the account. Tokens that do not record their
+// region are accepted.
+func CheckRegion(region string, token *types.TokenData, profileArn string) error {
+	if token != nil && token.Region != "" && token.Region != region {
+		return fmt.Errorf("token was issued in region %s but the account is configured for %s", token.Region, region)
+	}
+	if profileArn != "" {
+		if arnRegion := config.RegionFromArn(profileArn); arnRegion != region {
+			return fmt.Errorf("profile %s is in region %q but the account is configured for %s", profileArn, arnRegion, region)
+		}
+	}
+	return nil
+}
+
+// applyProfiles caches the discovered profiles on the token and keeps the
+// current selection if it is still available, otherwise picks the first.
+func applyProfiles(token *types.TokenData, profiles []types.Profile) {
+	token.Profiles = profiles
+	for _, p := range profiles {
+		if p.Arn == token.ProfileArn {
+			return
+		}
+	}
+	if len(profiles) > 0 {
+		token.ProfileArn = profiles[0].Arn
+	}
+}
+
+func (s *service) saveToken(token *types.TokenData) error {
 	newData, err := json.MarshalIndent(token, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to serialize new token: %w", err)
 	}
 
-	if err := os.WriteFile(tokenPath, newData, 0600); err != nil {
-		return fmt.Errorf("failed to write token file: %w", err)
+	if err := s.store.Save(s.account, newData); err != nil {
+		return fmt.Errorf("failed to save token to %s: %w", s.store.Name(), err)
+	}
+	s.mu.Lock()
+	cached := *token
+	s.cached, s.cachedSource = &cached, s.store.Location(s.account)
+	s.mu.Unlock()
+
+	// Once the token lives in a protected store, drop the plaintext copy an
+	// older kiro2cc left in its own config directory. Files elsewhere, such
+	// as the one Kiro writes, are never touched.
+	if _, plaintext := s.store.(plaintextStore); !plaintext && s.ownsTokenFile() {
+		if err := os.Remove(s.account.TokenFilePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove plaintext token file: %w", err)
+		}
 	}
 
 	return nil
 }
+
+func (s *service) ownsTokenFile() bool {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(configDir, s.account.TokenFilePath)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
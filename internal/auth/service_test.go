@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// countingStore is an in-memory SecretStore that counts its loads.
+type countingStore struct {
+	data  []byte
+	loads int
+}
+
+func (s *countingStore) Name() string                         { return "counting" }
+func (s *countingStore) Location(config.AccountConfig) string { return "memory" }
+func (s *countingStore) Delete(config.AccountConfig) error    { s.data = nil; return nil }
+func (s *countingStore) Save(_ config.AccountConfig, data []byte) error {
+	s.data = data
+	return nil
+}
+
+func (s *countingStore) Load(config.AccountConfig) ([]byte, error) {
+	s.loads++
+	if s.data == nil {
+		return nil, ErrSecretNotFound
+	}
+	return s.data, nil
+}
+
+func TestGetTokenCachesTheStoredToken(t *testing.T) {
+	store := &countingStore{data: []byte(`{"accessToken":"a1","refreshToken":"r"}`)}
+	account := config.AccountConfig{Name: "work", TokenFilePath: filepath.Join(t.TempDir(), "token.json")}
+	s := &service{account: account, store: store}
+
+	for range 3 {
+		token, err := s.GetToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "a1" {
+			t.Fatalf("AccessToken = %q, want a1", token.AccessToken)
+		}
+		token.AccessToken = "modified"
+	}
+	if store.loads != 1 {
+		t.Fatalf("store loaded %d times, want once", store.loads)
+	}
+
+	store.data = []byte(`{"accessToken":"a2","refreshToken":"r"}`)
+	s.ForgetToken()
+	if token, _ := s.GetToken(); token.AccessToken != "a2" || store.loads != 2 {
+		t.Fatalf("after ForgetToken got %q with %d loads, want a2 with 2", token.AccessToken, store.loads)
+	}
+
+	token, _ := s.GetToken()
+	token.AccessToken = "a3"
+	if err := s.saveToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := s.GetToken(); token.AccessToken != "a3" || store.loads != 2 {
+		t.Fatalf("after saving got %q with %d loads, want a3 without a load", token.AccessToken, store.loads)
+	}
+}
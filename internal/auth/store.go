@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// ErrSecretNotFound is returned by a SecretStore that holds nothing for
+// the requested account.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore persists the serialized token of an account.
+type SecretStore interface {
+	// Name describes the backend for users, e.g. in `kiro2cc read`.
+	Name() string
+	Load(account config.AccountConfig) ([]byte, error)
+	Save(account config.AccountConfig, data []byte) error
+	Delete(account config.AccountConfig) error
+	// Location describes where the account's secret lives.
+	Location(account config.AccountConfig) string
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]SecretStore{}
+)
+
+// NewSecretStore returns the backend selected by cfg.Auth.SecretStore.
+// "auto" prefers the Secret Service keyring and falls back to the
+// encrypted file when no keyring is reachable over D-Bus.
+func NewSecretStore(cfg *config.Config) SecretStore {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	backend := cfg.Auth.SecretStore
+	if store, ok := stores[backend]; ok {
+		return store
+	}
+
+	var store SecretStore
+	switch backend {
+	case config.StorePlaintext:
+		store = plaintextStore{}
+	case config.StoreEncrypted:
+		store = newEncryptedFileStore()
+	case config.StoreKeyring:
+		ks, err := newKeyringStore()
+		if err != nil {
+			store = unavailableStore{name: "keyring", err: err}
+		} else {
+			store = ks
+		}
+	default:
+		if ks, err := newKeyringStore(); err == nil {
+			store = ks
+		} else {
+			store = newEncryptedFileStore()
+		}
+	}
+
+	stores[backend] = store
+	return store
+}
+
+// plaintextStore keeps the token as JSON in the account's token file, the
+// format kiro2cc has always used.
+type plaintextStore struct{}
+
+func (plaintextStore) Name() string { return "plaintext file" }
+
+func (plaintextStore) Location(account config.AccountConfig) string {
+	return account.TokenFilePath
+}
+
+func (plaintextStore) Load(account config.AccountConfig) ([]byte, error) {
+	data, err := os.ReadFile(account.TokenFilePath)
+	if os.IsNotExist(err) {
+		return nil, ErrSecretNotFound
+	}
+	return data, err
+}
+
+func (plaintextStore) Save(account config.AccountConfig, data []byte) error {
+	return writePrivateFile(account.TokenFilePath, data)
+}
+
+func (plaintextStore) Delete(account config.AccountConfig) error {
+	if err := os.Remove(account.TokenFilePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// unavailableStore stands in for a backend that was explicitly requested
+// but cannot be used, so every operation reports why.
+type unavailableStore struct {
+	name string
+	err  error
+}
+
+func (s unavailableStore) Name() string { return s.name }
+
+func (s unavailableStore) Location(config.AccountConfig) string { return s.name }
+
+func (s unavailableStore) Load(config.AccountConfig) ([]byte, error) {
+	return nil, fmt.Errorf("%s secret store unavailable: %w", s.name, s.err)
+}
+
+func (s unavailableStore) Save(config.AccountConfig, []byte) error {
+	return fmt.Errorf("%s secret store unavailable: %w", s.name, s.err)
+}
+
+func (s unavailableStore) Delete(config.AccountConfig) error {
+	return fmt.Errorf("%s secret store unavailable: %w", s.name, s.err)
+}
+
+func writePrivateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// PassphraseEnv names the environment variable holding the passphrase for
+// the encrypted token file. Without it the file is sealed with a random key
+// kept in the config directory.
+const PassphraseEnv = "KIRO2CC_PASSPHRASE"
+
+const (
+	kdfPassphrase    = "pbkdf2-sha256"
+	kdfMachine       = "machine"
+	pbkdf2Iterations = 600000
+)
+
+// encryptedFile is the on-disk format of the encrypted store.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedFileStore seals the token with AES-256-GCM next to where the
+// plaintext token file would be.
+type encryptedFileStore struct {
+	passphrase string
+}
+
+func newEncryptedFileStore() *encryptedFileStore {
+	return &encryptedFileStore{passphrase: os.Getenv(PassphraseEnv)}
+}
+
+func (s *encryptedFileStore) Name() string { return "encrypted file" }
+
+func (s *encryptedFileStore) Location(account config.AccountConfig) string {
+	return encryptedPath(account)
+}
+
+func encryptedPath(account config.AccountConfig) string {
+	return strings.TrimSuffix(account.TokenFilePath, ".json") + ".enc"
+}
+
+func (s *encryptedFileStore) Load(account config.AccountConfig) ([]byte, error) {
+	data, err := os.ReadFile(encryptedPath(account))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSecretNotFound
+		}
+		return nil, err
+	}
+
+	var file encryptedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted token file: %w", err)
+	}
+
+	key, err := s.key(file.KDF, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, []byte(account.Name))
+	if err != nil {
+		if file.KDF == kdfPassphrase {
+			return nil, fmt.Errorf("failed to decrypt token file, check %s", PassphraseEnv)
+		}
+		return nil, fmt.Errorf("failed to decrypt token file, it may have been created on another machine")
+	}
+	return plaintext, nil
+}
+
+func (s *encryptedFileStore) Save(account config.AccountConfig, data []byte) error {
+	file := encryptedFile{Version: 1, KDF: kdfMachine}
+	if s.passphrase != "" {
+		file.KDF = kdfPassphrase
+		file.Iterations = pbkdf2Iterations
+	}
+
+	file.Salt = make([]byte, 16)
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	key, err := s.key(file.KDF, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = gcm.Seal(nil, file.Nonce, data, []byte(account.Name))
+
+	out, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(encryptedPath(account), out)
+}
+
+func (s *encryptedFileStore) Delete(account config.AccountConfig) error {
+	if err := os.Remove(encryptedPath(account)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *encryptedFileStore) key(kdf string, salt []byte, iterations int) ([]byte, error) {
+	switch kdf {
+	case kdfPassphrase:
+		if s.passphrase == "" {
+			return nil, fmt.Errorf("token file is passphrase protected, set %s", PassphraseEnv)
+		}
+		return pbkdf2SHA256([]byte(s.passphrase), salt, iterations, 32), nil
+	case kdfMachine:
+		secret, err := machineSecret()
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(salt)
+		return mac.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q", kdf)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// machineSecret returns the random key kept in the config directory,
+// generating it on first use. It is written 0600 so that only the user can
+// read it, which is what protects the token file without a passphrase.
+func machineSecret() ([]byte, error) {
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(configDir, "machine.key")
+	key, err := os.ReadFile(keyPath)
+	if err == nil {
+		// Replacing a damaged key would lose every token sealed with it.
+		if len(key) != 32 {
+			return nil, fmt.Errorf("machine key %s is malformed, restore it or remove it and log in again", keyPath)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read machine key: %w", err)
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := writePrivateFile(keyPath, key); err != nil {
+		return nil, fmt.Errorf("failed to write machine key: %w", err)
+	}
+	return key, nil
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	out := make([]byte, 0, blocks*hashLen)
+	var counter [4]byte
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+const (
+	secretsBusName         = "org.freedesktop.secrets"
+	secretsPath            = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretsDefaultAlias    = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	secretsServiceIface    = "org.freedesktop.Secret.Service"
+	secretsCollectionIface = "org.freedesktop.Secret.Collection"
+	secretsItemIface       = "org.freedesktop.Secret.Item"
+	secretsPromptIface     = "org.freedesktop.Secret.Prompt"
+
+	keyringService = "kiro2cc"
+	promptTimeout  = 2 * time.Minute
+)
+
+// secret mirrors the Secret Service (oayays) struct.
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// keyringStore keeps tokens in the desktop keyring through the
+// freedesktop Secret Service API (GNOME Keyring, KWallet, KeePassXC).
+type keyringStore struct {
+	conn *dbus.Conn
+}
+
+// newKeyringStore connects to the session bus and checks that a Secret
+// Service implementation is running or can be activated.
+func newKeyringStore() (*keyringStore, error) {
+	address, err := sessionBusAddress()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		return nil, fmt.Errorf("no D-Bus session bus: %w", err)
+	}
+
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var activatable []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !contains(names, secretsBusName) && !contains(activatable, secretsBusName) {
+		conn.Close()
+		return nil, fmt.Errorf("no Secret Service provider on the session bus")
+	}
+
+	return &keyringStore{conn: conn}, nil
+}
+
+// sessionBusAddress finds an already running session bus. Unlike
+// dbus.ConnectSessionBus it never autolaunches a bus, which would leave a
+// stray dbus-daemon behind on headless machines.
+func sessionBusAddress() (string, error) {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+		return address, nil
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		socket := filepath.Join(runtimeDir, "bus")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix:path=" + socket, nil
+		}
+	}
+	return "", fmt.Errorf("no D-Bus session bus")
+}
+
+func (s *keyringStore) Name() string { return "keyring" }
+
+func (s *keyringStore) Location(account config.AccountConfig) string {
+	return fmt.Sprintf("Secret Service (service=%s, account=%s)", keyringService, account.Name)
+}
+
+func attributes(account config.AccountConfig) map[string]string {
+	return map[string]string{"service": keyringService, "account": account.Name}
+}
+
+func (s *keyringStore) service() dbus.BusObject {
+	return s.conn.Object(secretsBusName, secretsPath)
+}
+
+func (s *keyringStore) openSession() (dbus.ObjectPath, error) {
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err := s.service().Call(secretsServiceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		return "", fmt.Errorf("failed to open Secret Service session: %w", err)
+	}
+	return session, nil
+}
+
+func (s *keyringStore) closeSession(session dbus.ObjectPath) {
+	s.conn.Object(secretsBusName, session).Call("org.freedesktop.Secret.Session.Close", 0)
+}
+
+// findItem returns the keyring item of the account, unlocking it if the
+// keyring is locked. It returns "" when there is no item.
+func (s *keyringStore) findItem(account config.AccountConfig) (dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := s.service().Call(secretsServiceIface+".SearchItems", 0, attributes(account)).Store(&unlocked, &locked)
+	if err != nil {
+		return "", fmt.Errorf("failed to search keyring: %w", err)
+	}
+	if len(unlocked) > 0 {
+		return unlocked[0], nil
+	}
+	if len(locked) == 0 {
+		return "", nil
+	}
+
+	var prompt dbus.ObjectPath
+	err = s.service().Call(secretsServiceIface+".Unlock", 0, locked[:1]).Store(&unlocked, &prompt)
+	if err != nil {
+		return "", fmt.Errorf("failed to unlock keyring: %w", err)
+	}
+	if err := s.prompt(prompt); err != nil {
+		return "", err
+	}
+	return locked[0], nil
+}
+
+// prompt shows a Secret Service prompt, if one was returned, and waits
+// for the user to answer it.
+func (s *keyringStore) prompt(path dbus.ObjectPath) error {
+	if path == "" || path == "/" {
+		return nil
+	}
+
+	if err := s.conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(secretsPromptIface),
+		dbus.WithMatchMember("Completed"),
+	); err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(secretsBusName, path).Call(secretsPromptIface+".Prompt", 0, "").Err; err != nil {
+		return fmt.Errorf("failed to show keyring prompt: %w", err)
+	}
+
+	timeout := time.After(promptTimeout)
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Path != path || len(sig.Body) == 0 {
+				continue
+			}
+			if dismissed, _ := sig.Body[0].(bool); dismissed {
+				return fmt.Errorf("keyring prompt was dismissed")
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for keyring prompt")
+		}
+	}
+}
+
+func (s *keyringStore) Load(account config.AccountConfig) ([]byte, error) {
+	item, err := s.findItem(account)
+	if err != nil {
+		return nil, err
+	}
+	if item == "" {
+		return nil, ErrSecretNotFound
+	}
+
+	session, err := s.openSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeSession(session)
+
+	var sec secret
+	if err := s.conn.Object(secretsBusName, item).Call(secretsItemIface+".GetSecret", 0, session).Store(&sec); err != nil {
+		return nil, fmt.Errorf("failed to read keyring item: %w", err)
+	}
+	return sec.Value, nil
+}
+
+func (s *keyringStore) Save(account config.AccountConfig, data []byte) error {
+	session, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer s.closeSession(session)
+
+	properties := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Item.Label":      dbus.MakeVariant("kiro2cc token (" + account.Name + ")"),
+		"org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(attributes(account)),
+	}
+	sec := secret{Session: session, Value: data, ContentType: "application/json"}
+
+	var item, prompt dbus.ObjectPath
+	err = s.conn.Object(secretsBusName, secretsDefaultAlias).
+		Call(secretsCollectionIface+".CreateItem", 0, properties, sec, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed to write keyring item: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+func (s *keyringStore) Delete(account config.AccountConfig) error {
+	item, err := s.findItem(account)
+	if err != nil || item == "" {
+		return err
+	}
+
+	var prompt dbus.ObjectPath
+	if err := s.conn.Object(secretsBusName, item).Call(secretsItemIface+".Delete", 0).Store(&prompt); err != nil {
+		return fmt.Errorf("failed to delete keyring item: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+func TestEncryptedFileStoreRoundTrip(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	account := config.AccountConfig{Name: "work", TokenFilePath: filepath.Join(t.TempDir(), "token.json")}
+	data := []byte(`{"accessToken":"a","refreshToken":"r"}`)
+
+	for _, passphrase := range []string{"", "correct horse"} {
+		store := &encryptedFileStore{passphrase: passphrase}
+		if err := store.Save(account, data); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Load(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Load() = %s, want %s", got, data)
+		}
+	}
+
+	wrong := &encryptedFileStore{passphrase: "wrong"}
+	if _, err := wrong.Load(account); err == nil {
+		t.Fatal("expected decryption with the wrong passphrase to fail")
+	}
+	renamed := account
+	renamed.Name = "personal"
+	if _, err := (&encryptedFileStore{passphrase: "correct horse"}).Load(renamed); err == nil {
+		t.Fatal("expected a token bound to another account to be rejected")
+	}
+}
+
+func TestMalformedMachineKeyIsKept(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	configDir, err := config.GetConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(configDir, "machine.key")
+	if err := writePrivateFile(keyPath, []byte("truncated")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machineSecret(); err == nil {
+		t.Fatal("a malformed machine key was accepted")
+	}
+	if data, err := os.ReadFile(keyPath); err != nil || string(data) != "truncated" {
+		t.Fatalf("machine key was replaced: %q, %v", data, err)
+	}
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914 section 11 test vector.
+	got := fmt.Sprintf("%x", pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Fatalf("pbkdf2 = %s, want %s", got, want)
+	}
+}
+
+// fakeSecretService implements just enough of org.freedesktop.Secret.*
+// for keyringStore, with every item unlocked and no prompts.
+type fakeSecretService struct {
+	conn  *dbus.Conn
+	mu    sync.Mutex
+	items map[dbus.ObjectPath]fakeItem
+	next  int
+}
+
+type fakeItem struct {
+	attrs map[string]string
+	value []byte
+}
+
+func (f *fakeSecretService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/1", nil
+}
+
+func (f *fakeSecretService) SearchItems(attrs map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []dbus.ObjectPath
+	for path, item := range f.items {
+		if item.attrs["service"] == attrs["service"] && item.attrs["account"] == attrs["account"] {
+			found = append(found, path)
+		}
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (f *fakeSecretService) CreateItem(props map[string]dbus.Variant, sec secret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	attrs := props["org.freedesktop.Secret.Item.Attributes"].Value().(map[string]string)
+	found, _, _ := f.SearchItems(attrs)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := dbus.ObjectPath("")
+	if replace && len(found) > 0 {
+		path = found[0]
+	} else {
+		f.next++
+		path = dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/secrets/collection/login/%d", f.next))
+		f.conn.Export(&fakeItemObject{f, path}, path, secretsItemIface)
+	}
+	f.items[path] = fakeItem{attrs: attrs, value: sec.Value}
+	return path, "/", nil
+}
+
+type fakeItemObject struct {
+	service *fakeSecretService
+	path    dbus.ObjectPath
+}
+
+func (o *fakeItemObject) GetSecret(session dbus.ObjectPath) (secret, *dbus.Error) {
+	o.service.mu.Lock()
+	defer o.service.mu.Unlock()
+	return secret{Session: session, Value: o.service.items[o.path].value, ContentType: "application/json"}, nil
+}
+
+func (o *fakeItemObject) Delete() (dbus.ObjectPath, *dbus.Error) {
+	o.service.mu.Lock()
+	defer o.service.mu.Unlock()
+	delete(o.service.items, o.path)
+	return "/", nil
+}
+
+type fakeSession struct{}
+
+func (fakeSession) Close() *dbus.Error { return nil }
+
+// startSessionBus runs a private dbus-daemon for the test and points
+// DBUS_SESSION_BUS_ADDRESS at it.
+func startSessionBus(t *testing.T) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	socket := filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address", "--address=unix:path="+socket)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon did not print its address: %v", err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(address))
+}
+
+func TestKeyringStoreWithFakeSecretService(t *testing.T) {
+	startSessionBus(t)
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fake := &fakeSecretService{conn: conn, items: map[dbus.ObjectPath]fakeItem{}}
+	conn.Export(fake, secretsPath, secretsServiceIface)
+	conn.Export(fake, secretsDefaultAlias, secretsCollectionIface)
+	conn.Export(fakeSession{}, "/org/freedesktop/secrets/session/1", "org.freedesktop.Secret.Session")
+	if reply, err := conn.RequestName(secretsBusName, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to own %s: %v", secretsBusName, err)
+	}
+
+	store, err := newKeyringStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := config.AccountConfig{Name: "work"}
+
+	if _, err := store.Load(account); err != ErrSecretNotFound {
+		t.Fatalf("Load() on empty keyring = %v, want ErrSecretNotFound", err)
+	}
+
+	for _, value := range []string{`{"accessToken":"one"}`, `{"accessToken":"two"}`} {
+		if err := store.Save(account, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Load(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			t.Fatalf("Load() = %s, want %s", got, value)
+		}
+	}
+	if len(fake.items) != 1 {
+		t.Fatalf("keyring holds %d items, want the item replaced in place", len(fake.items))
+	}
+
+	if err := store.Delete(account); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(account); err != ErrSecretNotFound {
+		t.Fatalf("Load() after Delete = %v, want ErrSecretNotFound", err)
+	}
+}
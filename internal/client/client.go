@@ -2,16 +2,37 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/tracing"
 	"github.com/shyn/kiro2cc/pkg/types"
 )
 
+// RequestIDHeader carries the proxy's request ID on upstream calls so
+// that they can be matched with the proxy's logs.
+const RequestIDHeader = "x-request-id"
+
+type requestIDKey struct{}
+
+// WithRequestID attaches the ID the proxy assigned to a request to ctx.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the request ID attached to ctx, if any.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
 type CodeWhispererClient interface {
-	SendRequest(req *types.CodeWhispererRequest, accessToken string, stream bool) (*http.Response, error)
+	SendRequest(ctx context.Context, req *types.CodeWhispererRequest, accessToken, region string, stream bool) (*http.Response, error)
+	ListAvailableProfiles(accessToken, region string) ([]types.Profile, error)
 }
 
 type client struct {
@@ -37,20 +58,26 @@ func NewCodeWhispererClientWithHTTPClient(cfg *config.Config, httpClient HTTPCli
 	}
 }
 
-func (c *client) SendRequest(req *types.CodeWhispererRequest, accessToken string, stream bool) (*http.Response, error) {
+func (c *client) SendRequest(ctx context.Context, req *types.CodeWhispererRequest, accessToken, region string, stream bool) (*http.Response, error) {
 	reqBody, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to serialize request: %w", err)
 	}
 
-	url := c.config.CodeWhisperer.BaseURL + "/generateAssistantResponse"
-	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(reqBody))
+	// The request is bound to ctx so a client that goes away also aborts
+	// the upstream call and its response body.
+	url := c.config.CodeWhispererURL(region) + "/generateAssistantResponse"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httpReq.Header.Set("Authorization", "Bearer "+accessToken)
 	httpReq.Header.Set("Content-Type", "application/json")
+	if id := RequestIDFrom(ctx); id != "" {
+		httpReq.Header.Set(RequestIDHeader, id)
+	}
+	tracing.Inject(ctx, httpReq.Header)
 
 	if stream {
 		httpReq.Header.Set("Accept", "text/event-stream")
@@ -64,3 +91,51 @@ func (c *client) SendRequest(req *types.CodeWhispererRequest, accessToken string
 	return resp, nil
 }
 
+// ListAvailableProfiles returns every CodeWhisperer profile the access
+// token may use, following pagination until the list is exhausted.
+func (c *client) ListAvailableProfiles(accessToken, region string) ([]types.Profile, error) {
+	var profiles []types.Profile
+	var nextToken *string
+
+	for {
+		reqBody, err := json.Marshal(types.ListAvailableProfilesRequest{
+			MaxResults: 50,
+			NextToken:  nextToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize request: %w", err)
+		}
+
+		httpReq, err := http.NewRequest(http.MethodPost, c.config.CodeWhispererURL(region)+"/", bytes.NewBuffer(reqBody))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+accessToken)
+		httpReq.Header.Set("Content-Type", "application/x-amz-json-1.0")
+		httpReq.Header.Set("X-Amz-Target", "AmazonCodeWhispererService.ListAvailableProfiles")
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("ListAvailableProfiles failed with status %d: %s", resp.StatusCode, string(body))
+		}
+
+		var page types.ListAvailableProfilesResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		profiles = append(profiles, page.Profiles...)
+
+		if page.NextToken == nil || *page.NextToken == "" {
+			return profiles, nil
+		}
+		nextToken = page.NextToken
+	}
+}
@@ -1,33 +1,187 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Server        ServerConfig
-	Auth          AuthConfig
-	CodeWhisperer CodeWhispererConfig
+	// Region is the AWS region of the Kiro account. It derives the
+	// CodeWhisperer endpoint, the token refresh endpoint and the region
+	// expected in profile ARNs.
+	Region        string              `json:"region"`
+	Server        ServerConfig        `json:"server"`
+	Auth          AuthConfig          `json:"auth"`
+	CodeWhisperer CodeWhispererConfig `json:"codewhisperer"`
+	Accounts      []AccountConfig     `json:"accounts,omitempty"`
+	Log           LogConfig           `json:"log"`
+	Traffic       TrafficConfig       `json:"traffic"`
+	Tracing       TracingConfig       `json:"tracing"`
+	Usage         UsageConfig         `json:"usage"`
+	RateLimit     RateLimitConfig     `json:"rateLimit"`
+	Queue         QueueConfig         `json:"queue"`
+}
+
+// LogConfig controls what the server logs and, when started with
+// --daemon, the log file it writes.
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is text or json.
+	Format string `json:"format"`
+	File   string `json:"file"`
+	// MaxSizeMB rotates the file when it would grow past this size.
+	MaxSizeMB int `json:"maxSizeMB"`
+	// RotateEvery rotates the file once it is this old.
+	RotateEvery Duration `json:"rotateEvery"`
+	// MaxAge and MaxBackups bound how many rotated files are kept.
+	MaxAge     Duration `json:"maxAge"`
+	MaxBackups int      `json:"maxBackups"`
+	Compress   bool     `json:"compress"`
+}
+
+// TrafficConfig controls the opt-in traffic log, which keeps the bodies of
+// every request, its CodeWhisperer request and frames, and the response.
+type TrafficConfig struct {
+	Enabled bool   `json:"enabled"`
+	Dir     string `json:"dir"`
+	// MaxBodyBytes truncates each recorded body.
+	MaxBodyBytes int `json:"maxBodyBytes"`
+	// MaxTotalMB caps the directory; the oldest files are deleted first.
+	MaxTotalMB int          `json:"maxTotalMB"`
+	Redact     RedactConfig `json:"redact"`
+}
+
+// RedactConfig selects what is removed from recorded traffic.
+type RedactConfig struct {
+	APIKeys bool `json:"apiKeys"`
+	Emails  bool `json:"emails"`
+	// Patterns are additional regular expressions to redact.
+	Patterns []string `json:"patterns,omitempty"`
 }
 
 type ServerConfig struct {
-	Port         string
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	PIDFilePath  string
+	// Listen holds the addresses to serve on, each either "host:port" or
+	// "unix:///path/to.sock". When empty the server listens on loopback at
+	// Port.
+	Listen            []string `json:"listen,omitempty"`
+	Port              string   `json:"port"`
+	ReadTimeout       Duration `json:"readTimeout"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	// WriteTimeout bounds writing a response. Streaming responses apply it
+	// to each event instead, so a stream may run up to MaxStreamDuration.
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	// MaxStreamDuration bounds a whole request, streaming or not, and must
+	// be positive.
+	MaxStreamDuration Duration `json:"maxStreamDuration"`
+	// PingInterval is how often an SSE ping is sent while a stream waits on
+	// upstream. Zero disables pings.
+	PingInterval Duration `json:"pingInterval"`
+	PIDFilePath  string   `json:"pidFile"`
+	// ShutdownGracePeriod is how long in-flight requests may keep running
+	// after a stop signal before their connections are closed. Zero closes
+	// them at once.
+	ShutdownGracePeriod Duration `json:"shutdownGracePeriod"`
+	// RequireAPIKey rejects requests without a valid local API key.
+	RequireAPIKey bool `json:"requireAPIKey"`
+	// APIKeys are accepted in addition to the keys issued with `kiro2cc keys`.
+	APIKeys      []string `json:"apiKeys,omitempty"`
+	KeysFilePath string   `json:"keysFile"`
 }
 
 type AuthConfig struct {
-	TokenFilePath   string
-	RefreshTokenURL string
+	TokenFilePath string `json:"tokenFile"`
+	// RefreshTokenURL overrides the refresh endpoint derived from the region.
+	RefreshTokenURL string `json:"refreshTokenURL,omitempty"`
+	// SelectionPolicy decides which account serves a request when several
+	// are configured: "round-robin", "least-throttled" or "sticky".
+	SelectionPolicy string `json:"selectionPolicy"`
+	// ThrottleCooldown is how long an account is skipped after upstream
+	// reports throttling or quota exhaustion without a Retry-After hint.
+	ThrottleCooldown Duration `json:"throttleCooldown"`
+	// SecretStore is where refreshed tokens are kept: "auto", "keyring",
+	// "encrypted" or "plaintext".
+	SecretStore string `json:"secretStore"`
+}
+
+// AccountConfig describes one named Kiro account in the token pool. An
+// empty ProfileArn means the profile discovered for the token is used.
+type AccountConfig struct {
+	Name          string `json:"name"`
+	TokenFilePath string `json:"tokenFile"`
+	ProfileArn    string `json:"profileArn,omitempty"`
+	// Region overrides the global region for this account.
+	Region string `json:"region,omitempty"`
 }
 
 type CodeWhispererConfig struct {
-	BaseURL    string
-	ProfileArn string
-	ProxyURL   string
+	// BaseURL overrides the endpoint derived from the region.
+	BaseURL string `json:"baseURL,omitempty"`
+	// ProfileArn is the last-resort profile used when none was configured
+	// or discovered for an account in the same region.
+	ProfileArn string `json:"profileArn"`
+	ProxyURL   string `json:"proxyURL"`
+	// SystemPrompt is how the system prompt is passed on. CodeWhisperer
+	// has no field for one, so it always travels as message text:
+	// "prepend" puts it at the start of the first user message, "history"
+	// sends each block as an earlier user turn that the assistant
+	// acknowledged.
+	SystemPrompt string `json:"systemPrompt"`
+}
+
+const (
+	PolicyRoundRobin     = "round-robin"
+	PolicyLeastThrottled = "least-throttled"
+	PolicySticky         = "sticky"
+
+	StoreAuto      = "auto"
+	StoreKeyring   = "keyring"
+	StoreEncrypted = "encrypted"
+	StorePlaintext = "plaintext"
+
+	SystemPromptPrepend = "prepend"
+	SystemPromptHistory = "history"
+
+	DefaultAccountName = "default"
+	DefaultRegion      = "us-east-1"
+)
+
+// KnownRegions lists the regions Kiro is known to serve. Other regions are
+// accepted as long as they look like an AWS region, so a new one only
+// needs a config change, but the server warns about them at startup.
+var KnownRegions = []string{"us-east-1", "eu-central-1"}
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-[0-9]$`)
+
+// Duration is a time.Duration that reads and writes as a Go duration
+// string ("30s", "5m") in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
 }
 
 // GetConfigDir gets the configuration directory for kiro2cc.
@@ -39,6 +193,73 @@ func GetConfigDir() (string, error) {
 	return filepath.Join(home, ".config", "kiro2cc"), nil
 }
 
+// GetConfigFilePath returns the path of the optional user config file.
+func GetConfigFilePath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "config.json"), nil
+}
+
+// RateLimitConfig limits how fast clients may use the proxy. Global limits
+// apply to all requests together, PerKey limits to each local API key on
+// its own, and Keys overrides PerKey for keys named by ID or name.
+type RateLimitConfig struct {
+	Global Limits            `json:"global"`
+	PerKey Limits            `json:"perKey"`
+	Keys   map[string]Limits `json:"keys,omitempty"`
+}
+
+// Limits are token-bucket rates. Zero means unlimited.
+type Limits struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	// TokensPerDay counts the input and output tokens reported to clients.
+	TokensPerDay int `json:"tokensPerDay"`
+}
+
+// Enabled reports whether any limit is set.
+func (l Limits) Enabled() bool {
+	return l.RequestsPerMinute > 0 || l.TokensPerDay > 0
+}
+
+// QueueConfig bounds how many CodeWhisperer calls run at once. Requests
+// over the limit wait in a queue, highest priority first and otherwise in
+// the order they arrived.
+type QueueConfig struct {
+	// MaxInFlight is the number of concurrent upstream calls. Zero
+	// disables the queue.
+	MaxInFlight int `json:"maxInFlight"`
+	// MaxQueued rejects requests once this many are already waiting.
+	MaxQueued int `json:"maxQueued"`
+	// Timeout is how long a request may wait for its turn.
+	Timeout Duration `json:"timeout"`
+	// Priorities maps API key names or IDs to a priority. Higher goes
+	// first; keys not listed have priority 0.
+	Priorities map[string]int `json:"priorities,omitempty"`
+}
+
+// UsageConfig controls the usage ledger, one JSON line per completed
+// request, which `kiro2cc usage` reports on.
+type UsageConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"`
+}
+
+// TracingConfig controls the optional export of OpenTelemetry traces over
+// OTLP/HTTP.
+type TracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Endpoint is the collector's OTLP/HTTP traces URL.
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every export, for collectors that need auth.
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"serviceName"`
+	// SampleRatio is the share of new traces that are recorded. Requests
+	// with a traceparent header follow the caller's sampling decision.
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
 // Default creates a default configuration.
 func Default() (*Config, error) {
 	configDir, err := GetConfigDir()
@@ -52,20 +273,290 @@ func Default() (*Config, error) {
 	}
 
 	return &Config{
+		Region: DefaultRegion,
 		Server: ServerConfig{
-			Port:         "8080",
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			PIDFilePath:  filepath.Join(configDir, "kiro2cc.pid"),
+			Port:                "8080",
+			ReadTimeout:         Duration{30 * time.Second},
+			ReadHeaderTimeout:   Duration{10 * time.Second},
+			WriteTimeout:        Duration{30 * time.Second},
+			IdleTimeout:         Duration{120 * time.Second},
+			MaxStreamDuration:   Duration{30 * time.Minute},
+			PingInterval:        Duration{15 * time.Second},
+			PIDFilePath:         filepath.Join(configDir, "kiro2cc.pid"),
+			ShutdownGracePeriod: Duration{60 * time.Second},
+			RequireAPIKey:       true,
+			KeysFilePath:        filepath.Join(configDir, "keys.json"),
 		},
 		Auth: AuthConfig{
-			RefreshTokenURL: "https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken",
-			TokenFilePath:   filepath.Join(configDir, "kiro2cc-token.json"),
+			TokenFilePath:    filepath.Join(configDir, "kiro2cc-token.json"),
+			SelectionPolicy:  PolicyRoundRobin,
+			ThrottleCooldown: Duration{60 * time.Second},
+			SecretStore:      StoreAuto,
+		},
+		Log: LogConfig{
+			Level:       "info",
+			Format:      "text",
+			File:        filepath.Join(configDir, "logs", "kiro2cc.log"),
+			MaxSizeMB:   10,
+			RotateEvery: Duration{24 * time.Hour},
+			MaxAge:      Duration{7 * 24 * time.Hour},
+			MaxBackups:  10,
+			Compress:    true,
+		},
+		Traffic: TrafficConfig{
+			Dir:          filepath.Join(configDir, "traffic"),
+			MaxBodyBytes: 256 << 10,
+			MaxTotalMB:   100,
+			Redact: RedactConfig{
+				APIKeys: true,
+				Emails:  true,
+			},
+		},
+		Usage: UsageConfig{
+			Enabled: true,
+			File:    filepath.Join(configDir, "usage.jsonl"),
+		},
+		Queue: QueueConfig{
+			MaxQueued: 100,
+			Timeout:   Duration{2 * time.Minute},
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "http://localhost:4318/v1/traces",
+			ServiceName: "kiro2cc",
+			SampleRatio: 1,
 		},
 		CodeWhisperer: CodeWhispererConfig{
-			BaseURL:    "https://codewhisperer.us-east-1.amazonaws.com",
-			ProfileArn: "arn:aws:codewhisperer:us-east-1:699475941385:profile/EHGA3GRVQMUK",
-			ProxyURL:   "127.0.0.1:9000",
+			ProfileArn:   "arn:aws:codewhisperer:us-east-1:699475941385:profile/EHGA3GRVQMUK",
+			ProxyURL:     "127.0.0.1:9000",
+			SystemPrompt: SystemPromptPrepend,
 		},
 	}, nil
 }
+
+// Load creates the default configuration and overlays the user config
+// file on top of it, if one exists.
+func Load() (*Config, error) {
+	cfg, err := Default()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := GetConfigFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	cfg.Log.File = expandHome(cfg.Log.File)
+	cfg.Traffic.Dir = expandHome(cfg.Traffic.Dir)
+	cfg.Usage.File = expandHome(cfg.Usage.File)
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if !regionPattern.MatchString(c.Region) {
+		return fmt.Errorf("invalid region %q", c.Region)
+	}
+
+	if c.Server.MaxStreamDuration.Duration <= 0 {
+		return fmt.Errorf("server maxStreamDuration must be positive, got %s", c.Server.MaxStreamDuration)
+	}
+	if c.Server.PingInterval.Duration < 0 || c.Server.ShutdownGracePeriod.Duration < 0 {
+		return fmt.Errorf("server pingInterval and shutdownGracePeriod must not be negative")
+	}
+
+	switch c.Auth.SelectionPolicy {
+	case PolicyRoundRobin, PolicyLeastThrottled, PolicySticky:
+	default:
+		return fmt.Errorf("unknown account selection policy %q", c.Auth.SelectionPolicy)
+	}
+
+	switch c.CodeWhisperer.SystemPrompt {
+	case SystemPromptPrepend, SystemPromptHistory:
+	default:
+		return fmt.Errorf("unknown systemPrompt strategy %q, use %q or %q", c.CodeWhisperer.SystemPrompt, SystemPromptPrepend, SystemPromptHistory)
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unknown log level %q", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", c.Log.Format)
+	}
+
+	for _, pattern := range c.Traffic.Redact.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid traffic redaction pattern %q: %w", pattern, err)
+		}
+	}
+
+	for name, limits := range map[string]Limits{"global": c.RateLimit.Global, "perKey": c.RateLimit.PerKey} {
+		if limits.RequestsPerMinute < 0 || limits.TokensPerDay < 0 {
+			return fmt.Errorf("rateLimit.%s limits must not be negative", name)
+		}
+	}
+	for key, limits := range c.RateLimit.Keys {
+		if limits.RequestsPerMinute < 0 || limits.TokensPerDay < 0 {
+			return fmt.Errorf("rateLimit.keys[%q] limits must not be negative", key)
+		}
+	}
+
+	if c.Queue.MaxInFlight < 0 || c.Queue.MaxQueued < 0 || c.Queue.Timeout.Duration < 0 {
+		return fmt.Errorf("queue maxInFlight, maxQueued and timeout must not be negative")
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sampleRatio must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+	if c.Tracing.Enabled {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid tracing endpoint %q, use an http:// or https:// URL", c.Tracing.Endpoint)
+		}
+	}
+
+	for _, addr := range c.Server.Listen {
+		if err := ValidateListenAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	switch c.Auth.SecretStore {
+	case StoreAuto, StoreKeyring, StoreEncrypted, StorePlaintext:
+	default:
+		return fmt.Errorf("unknown secret store %q", c.Auth.SecretStore)
+	}
+
+	seen := make(map[string]bool, len(c.Accounts))
+	for i, acct := range c.Accounts {
+		if acct.Name == "" {
+			return fmt.Errorf("account #%d has no name", i+1)
+		}
+		if seen[acct.Name] {
+			return fmt.Errorf("duplicate account name %q", acct.Name)
+		}
+		seen[acct.Name] = true
+		if acct.TokenFilePath == "" {
+			return fmt.Errorf("account %q has no tokenFile", acct.Name)
+		}
+		if acct.Region != "" && !regionPattern.MatchString(acct.Region) {
+			return fmt.Errorf("account %q has invalid region %q", acct.Name, acct.Region)
+		}
+		if acct.ProfileArn != "" {
+			region := acct.Region
+			if region == "" {
+				region = c.Region
+			}
+			if arnRegion := RegionFromArn(acct.ProfileArn); arnRegion != region {
+				return fmt.Errorf("account %q is in region %s but its profile ARN is in %q", acct.Name, region, arnRegion)
+			}
+		}
+	}
+	return nil
+}
+
+// AccountList returns the configured accounts. Without an explicit
+// accounts section, the single default account is derived from the Auth
+// and CodeWhisperer settings.
+func (c *Config) AccountList() []AccountConfig {
+	if len(c.Accounts) == 0 {
+		return []AccountConfig{{
+			Name:          DefaultAccountName,
+			TokenFilePath: c.Auth.TokenFilePath,
+			Region:        c.Region,
+		}}
+	}
+
+	accounts := make([]AccountConfig, 0, len(c.Accounts))
+	for _, acct := range c.Accounts {
+		acct.TokenFilePath = expandHome(acct.TokenFilePath)
+		if acct.Region == "" {
+			acct.Region = c.Region
+		}
+		accounts = append(accounts, acct)
+	}
+	return accounts
+}
+
+// ListenAddresses returns the addresses the server listens on.
+func (c *Config) ListenAddresses() []string {
+	if len(c.Server.Listen) > 0 {
+		return c.Server.Listen
+	}
+	return []string{net.JoinHostPort("127.0.0.1", c.Server.Port)}
+}
+
+// CodeWhispererURL returns the CodeWhisperer endpoint for region.
+func (c *Config) CodeWhispererURL(region string) string {
+	if c.CodeWhisperer.BaseURL != "" {
+		return c.CodeWhisperer.BaseURL
+	}
+	return fmt.Sprintf("https://codewhisperer.%s.amazonaws.com", region)
+}
+
+// RefreshTokenURL returns the Kiro token refresh endpoint for region.
+func (c *Config) RefreshTokenURL(region string) string {
+	if c.Auth.RefreshTokenURL != "" {
+		return c.Auth.RefreshTokenURL
+	}
+	return fmt.Sprintf("https://prod.%s.auth.desktop.kiro.dev/refreshToken", region)
+}
+
+// RegionFromArn extracts the region field of an ARN, or "" if arn is not
+// an ARN.
+func RegionFromArn(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
+
+// UnixSocketPath returns the socket path of a "unix://" listen address.
+func UnixSocketPath(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return "", false
+	}
+	return expandHome(path), true
+}
+
+// ValidateListenAddress checks that addr is "host:port" or "unix:///path".
+func ValidateListenAddress(addr string) error {
+	if path, ok := UnixSocketPath(addr); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("unix socket path in %q must be absolute", addr)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,291 @@
+// Package logfile writes the daemon log, rotating it by size and age and
+// compressing and pruning the rotated files.
+package logfile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files so that they sort by age.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+type Options struct {
+	// MaxSize rotates the file before it grows past this many bytes.
+	MaxSize int64
+	// RotateEvery rotates a file once it has been written to for this long.
+	RotateEvery time.Duration
+	// MaxAge deletes rotated files older than this.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// Writer appends to a log file and rotates it as configured. Zero limits
+// disable the corresponding rotation or pruning.
+type Writer struct {
+	path string
+	opts Options
+	now  func() time.Time
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// cleanup runs compression and pruning in the background, one
+	// rotation at a time.
+	cleanup   sync.WaitGroup
+	cleanupMu sync.Mutex
+}
+
+// Open opens path for appending, creating it and its directory if needed.
+func Open(path string, opts Options) (*Writer, error) {
+	w := &Writer{path: path, opts: opts, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new log file now.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+// Close closes the file and waits for background compression to finish.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+
+	w.cleanup.Wait()
+	return err
+}
+
+func (w *Writer) shouldRotate(n int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.opts.MaxSize > 0 && w.size+n > w.opts.MaxSize {
+		return true
+	}
+	return w.opts.RotateEvery > 0 && w.now().Sub(w.openedAt) >= w.opts.RotateEvery
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	w.file = f
+	w.size = info.Size()
+	w.openedAt = w.now()
+	// An existing file keeps aging from when it was last rotated.
+	if w.size > 0 {
+		if backups, _ := Backups(w.path); len(backups) > 0 {
+			if rotated := backupTime(w.path, backups[len(backups)-1]); rotated.Before(w.openedAt) {
+				w.openedAt = rotated
+			}
+		}
+	}
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+
+	rotatedAt := w.now()
+	backup := backupName(w.path, rotatedAt)
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	w.cleanup.Add(1)
+	go func() {
+		defer w.cleanup.Done()
+		w.cleanupMu.Lock()
+		defer w.cleanupMu.Unlock()
+
+		if w.opts.Compress {
+			if err := compress(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", backup, err)
+			}
+		}
+		w.prune(rotatedAt)
+	}()
+	return nil
+}
+
+// prune deletes rotated files beyond MaxBackups or older than MaxAge.
+func (w *Writer) prune(now time.Time) {
+	backups, err := Backups(w.path)
+	if err != nil {
+		return
+	}
+	cutoff := time.Time{}
+	if w.opts.MaxAge > 0 {
+		cutoff = now.Add(-w.opts.MaxAge)
+	}
+	for i, backup := range backups {
+		tooMany := w.opts.MaxBackups > 0 && len(backups)-i > w.opts.MaxBackups
+		tooOld := !cutoff.IsZero() && backupTime(w.path, backup).Before(cutoff)
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
+
+// Backups returns the rotated files of the log at path, oldest first.
+func Backups(path string) ([]string, error) {
+	prefix, ext := backupPrefix(path)
+	matches, err := filepath.Glob(prefix + "*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, match := range matches {
+		if !backupTime(path, match).IsZero() {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// OpenReader opens the current or a rotated log file for reading,
+// decompressing it if needed.
+func OpenReader(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// backupPrefix splits "dir/kiro2cc.log" into "dir/kiro2cc-" and ".log".
+func backupPrefix(path string) (string, string) {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-", ext
+}
+
+func backupName(path string, t time.Time) string {
+	prefix, ext := backupPrefix(path)
+	return prefix + t.UTC().Format(backupTimeFormat) + ext
+}
+
+// backupTime returns when a rotated file was rotated, or the zero time if
+// name is not one of path's rotated files.
+func backupTime(path, name string) time.Time {
+	prefix, ext := backupPrefix(path)
+	stamp, ok := strings.CutPrefix(strings.TrimSuffix(name, ".gz"), prefix)
+	if !ok {
+		return time.Time{}
+	}
+	stamp, ok = strings.CutSuffix(stamp, ext)
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(backupTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
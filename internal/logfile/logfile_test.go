@@ -0,0 +1,103 @@
+package logfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string) string {
+	t.Helper()
+	r, err := OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriterRotatesBySizeAndCompresses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "kiro2cc.log")
+	w, err := Open(path, Options{MaxSize: 10, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	w.now = func() time.Time { now = now.Add(time.Second); return now }
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Backups() = %v, want 2 files", backups)
+	}
+	for i, want := range []string{"first\n", "second\n"} {
+		if !strings.HasSuffix(backups[i], ".log.gz") {
+			t.Fatalf("backup %s is not compressed", backups[i])
+		}
+		if got := readAll(t, backups[i]); got != want {
+			t.Fatalf("backup %d = %q, want %q", i, got, want)
+		}
+	}
+	if got := readAll(t, path); got != "third\n" {
+		t.Fatalf("current log = %q, want %q", got, "third\n")
+	}
+}
+
+func TestWriterRotatesByAgeAndPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kiro2cc.log")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A backup from long ago, which MaxAge should remove.
+	if err := os.WriteFile(backupName(path, now.Add(-30*24*time.Hour)), []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(path, Options{RotateEvery: time.Hour, MaxAge: 7 * 24 * time.Hour, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.now = func() time.Time { return now }
+	w.openedAt = now
+
+	for i := 0; i < 4; i++ {
+		if _, err := w.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(2 * time.Hour)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Backups() = %v, want the 2 newest", backups)
+	}
+	for _, backup := range backups {
+		if readAll(t, backup) == "old\n" {
+			t.Fatalf("expired backup %s was kept", backup)
+		}
+	}
+}
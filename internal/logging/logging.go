@@ -0,0 +1,98 @@
+// Package logging builds the slog logger shared by every kiro2cc package
+// and carries request-scoped attributes in contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing to w in the given format, dropping
+// records below level.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// ParseLevel accepts debug, info, warn or error.
+func ParseLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+	return lvl, nil
+}
+
+type contextKey struct{}
+
+// With returns a copy of ctx whose log records, when logged with one of
+// the *Context methods, carry args as extra attributes.
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append(attrsFrom(ctx), argsToAttrs(args)...)
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	// Copy so that contexts derived from the same parent don't share a
+	// backing array.
+	return append([]slog.Attr(nil), attrs...)
+}
+
+func argsToAttrs(args []any) []slog.Attr {
+	var r slog.Record
+	r.Add(args...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+// contextHandler adds the attributes stored with With to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if attrs, ok := ctx.Value(contextKey{}).([]slog.Attr); ok {
+			r.AddAttrs(attrs...)
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
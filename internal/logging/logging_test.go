@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestContextAttributesAndLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, FormatJSON, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := With(context.Background(), "request_id", "req_1")
+	ctx = With(ctx, "model", "claude-sonnet-4", "stream", true)
+	logger.DebugContext(ctx, "dropped")
+	logger.InfoContext(ctx, "kept", "status", 200)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("want exactly one JSON record, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"msg": "kept", "request_id": "req_1", "model": "claude-sonnet-4", "stream": true, "status": float64(200)}
+	for k, v := range want {
+		if record[k] != v {
+			t.Errorf("%s = %v, want %v", k, record[k], v)
+		}
+	}
+}
+
+func TestNewRejectsUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+	if _, err := New(&bytes.Buffer{}, FormatText, "verbose"); err == nil {
+		t.Error("expected an unknown level to be rejected")
+	}
+}
@@ -0,0 +1,239 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies of LLM requests, from a fast first token
+// to a long answer, in seconds.
+var DefaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Registry holds the metrics a server exposes.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter is a value that only goes up, per combination of label values.
+type Counter struct{ f *family }
+
+// Gauge is a value that goes up and down, per combination of label values.
+type Gauge struct{ f *family }
+
+// Histogram counts observations in buckets, per combination of label
+// values.
+type Histogram struct{ f *family }
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// NewHistogram creates a histogram with the given upper bucket bounds,
+// which must be sorted. A +Inf bucket is always added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: " + name + " registered twice")
+		}
+	}
+	f := &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Inc adds one to the counter for the label values.
+func (c *Counter) Inc(values ...string) { c.Add(1, values...) }
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.f.name + " cannot decrease")
+	}
+	c.f.update(values, func(s *series) { s.value += v })
+}
+
+func (g *Gauge) Inc(values ...string) { g.Add(1, values...) }
+
+func (g *Gauge) Dec(values ...string) { g.Add(-1, values...) }
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.update(values, func(s *series) { s.value += v })
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.update(values, func(s *series) { s.value = v })
+}
+
+// Observe records one observation, such as a latency in seconds.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.update(values, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.f.buckets))
+		}
+		for i, bound := range h.f.buckets {
+			if v <= bound {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// ServeHTTP writes every metric in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Write writes every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (f *family) update(values []string, fn func(*series)) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelSet(s.values, ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			var n uint64
+			if s.counts != nil {
+				n = s.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, formatFloat(bound)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelSet(s.values, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelSet(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelSet(s.values, ""), s.count)
+	}
+}
+
+// labelSet formats the labels of a series, adding the le label of a
+// histogram bucket when le is set.
+func (f *family) labelSet(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if le != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "le=\"%s\"", le)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("test_requests_total", "Requests served.", "route", "status")
+	active := r.NewGauge("test_active", "Active streams.")
+	latency := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.5, 1}, "account")
+
+	requests.Inc("/v1/messages", "200")
+	requests.Inc("/v1/messages", "200")
+	requests.Inc("/health", "200")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	latency.Observe(0.25, "work")
+	latency.Observe(0.75, "work")
+	latency.Observe(3, "work")
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{route="/health",status="200"} 1
+test_requests_total{route="/v1/messages",status="200"} 2
+# HELP test_active Active streams.
+# TYPE test_active gauge
+test_active 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{account="work",le="0.5"} 1
+test_latency_seconds_bucket{account="work",le="1"} 2
+test_latency_seconds_bucket{account="work",le="+Inf"} 3
+test_latency_seconds_sum{account="work"} 4
+test_latency_seconds_count{account="work"} 3
+`
+	if got := out.String(); got != want {
+		t.Fatalf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.", "model").Inc("a\"b\\c\nd")
+
+	var out strings.Builder
+	r.Write(&out)
+	if want := `test_total{model="a\"b\\c\nd"} 1`; !strings.Contains(out.String(), want) {
+		t.Fatalf("Write() =\n%s\nwant a line %s", out.String(), want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "route")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Inc() with missing label values did not panic")
+		}
+	}()
+	c.Inc()
+}
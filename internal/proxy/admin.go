@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/version"
+)
+
+// Status is the server state reported by GET /admin/status.
+type Status struct {
+	PID           int             `json:"pid"`
+	Version       string          `json:"version"`
+	StartedAt     time.Time       `json:"startedAt"`
+	UptimeSeconds int64           `json:"uptimeSeconds"`
+	Listen        []string        `json:"listen"`
+	Requests      RequestCounters `json:"requests"`
+	Queue         *QueueStatus    `json:"queue,omitempty"`
+	Accounts      []AccountStatus `json:"accounts"`
+}
+
+// QueueStatus is the state of the upstream queue, when one is configured.
+type QueueStatus struct {
+	MaxInFlight int `json:"maxInFlight"`
+	InFlight    int `json:"inFlight"`
+	Waiting     int `json:"waiting"`
+}
+
+// RequestCounters count /v1/messages requests since the server started.
+// Errors are requests answered with a 4xx or 5xx status.
+type RequestCounters struct {
+	Total  int64 `json:"total"`
+	Active int64 `json:"active"`
+	Errors int64 `json:"errors"`
+}
+
+type AccountStatus struct {
+	Name           string     `json:"name"`
+	Region         string     `json:"region"`
+	TokenExpiresAt *time.Time `json:"tokenExpiresAt,omitempty"`
+	TokenError     string     `json:"tokenError,omitempty"`
+	ThrottledUntil *time.Time `json:"throttledUntil,omitempty"`
+}
+
+func (s *Server) status() Status {
+	status := Status{
+		PID:           os.Getpid(),
+		Version:       version.Version,
+		StartedAt:     s.startedAt,
+		UptimeSeconds: int64(time.Since(s.startedAt).Seconds()),
+		Listen:        s.config.ListenAddresses(),
+		Requests: RequestCounters{
+			Total:  s.requests.Load(),
+			Active: s.inFlight.Load(),
+			Errors: s.failed.Load(),
+		},
+	}
+
+	if s.handlers.queue != nil {
+		inFlight, waiting := s.handlers.queue.Stats()
+		status.Queue = &QueueStatus{
+			MaxInFlight: s.config.Queue.MaxInFlight,
+			InFlight:    inFlight,
+			Waiting:     waiting,
+		}
+	}
+
+	for _, account := range s.handlers.accounts.Accounts() {
+		acct := AccountStatus{Name: account.Name, Region: account.Region()}
+		if token, err := account.GetToken(); err != nil {
+			acct.TokenError = err.Error()
+		} else if expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt); err == nil {
+			acct.TokenExpiresAt = &expiresAt
+		}
+		if until := s.handlers.accounts.ThrottledUntil(account); time.Now().Before(until) {
+			acct.ThrottledUntil = &until
+		}
+		status.Accounts = append(status.Accounts, acct)
+	}
+	return status
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errInvalidRequest, "Only GET requests are supported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// countMiddleware keeps the request counters reported by /admin/status.
+func (s *Server) countMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if rec.status >= 400 {
+			s.failed.Add(1)
+		}
+	}
+}
+
+// statusRecorder remembers the response status. Unwrap keeps
+// http.ResponseController working on the underlying writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
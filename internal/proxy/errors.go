@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Anthropic error types, see https://docs.anthropic.com/en/api/errors.
+const (
+	errInvalidRequest = "invalid_request_error"
+	errAuthentication = "authentication_error"
+	errRateLimit      = "rate_limit_error"
+	errAPI            = "api_error"
+	errOverloaded     = "overloaded_error"
+)
+
+// statusOverloaded is the status the Anthropic API answers overloaded_error
+// with.
+const statusOverloaded = 529
+
+// writeAPIError responds with an error body shaped like the Anthropic API's.
+func writeAPIError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+// throttleMarkers are the upstream error codes that mean the account is out
+// of capacity rather than the request being wrong.
+var throttleMarkers = [][]byte{
+	[]byte("ThrottlingException"),
+	[]byte("ServiceQuotaExceededException"),
+	[]byte("TooManyRequestsException"),
+}
+
+func isThrottled(statusCode int, body []byte) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	for _, marker := range throttleMarkers {
+		if bytes.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter understands both forms of the Retry-After header.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// conversationKey identifies a conversation for sticky account selection.
+// claude-code puts its session in metadata.user_id; other clients fall back
+// to a hash of the opening message, which stays the same on every turn.
+func conversationKey(req *types.AnthropicRequest) string {
+	if userID, ok := req.Metadata["user_id"].(string); ok && userID != "" {
+		return userID
+	}
+	if len(req.Messages) == 0 {
+		return ""
+	}
+	first, err := json.Marshal(req.Messages[0].Content)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(first)
+	return hex.EncodeToString(sum[:])
+}
@@ -1,142 +1,434 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/shyn/kiro2cc/internal/apikeys"
 	"github.com/shyn/kiro2cc/internal/auth"
 	"github.com/shyn/kiro2cc/internal/client"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/logging"
+	"github.com/shyn/kiro2cc/internal/queue"
+	"github.com/shyn/kiro2cc/internal/stopseq"
+	"github.com/shyn/kiro2cc/internal/tokens"
+	"github.com/shyn/kiro2cc/internal/tracing"
+	"github.com/shyn/kiro2cc/internal/traffic"
 	"github.com/shyn/kiro2cc/internal/translator"
 	"github.com/shyn/kiro2cc/parser"
 	"github.com/shyn/kiro2cc/pkg/types"
 )
 
 type Handlers struct {
-	authService auth.Service
-	translator  translator.Service
-	cwClient    client.CodeWhispererClient
-	logger      Logger
-}
-
-type Logger interface {
-	Info(msg string, args ...interface{})
-	Error(msg string, args ...interface{})
-	Debug(msg string, args ...interface{})
+	config     *config.Config
+	accounts   *auth.Pool
+	translator translator.Service
+	cwClient   client.CodeWhispererClient
+	traffic    *traffic.Recorder
+	tracer     *tracing.Tracer
+	queue      *queue.Queue
+	logger     *slog.Logger
+	metrics    *proxyMetrics
 }
 
 func NewHandlers(
-	authService auth.Service,
+	cfg *config.Config,
+	accounts *auth.Pool,
 	translator translator.Service,
 	cwClient client.CodeWhispererClient,
-	logger Logger,
+	recorder *traffic.Recorder,
+	tracer *tracing.Tracer,
+	logger *slog.Logger,
 ) *Handlers {
 	return &Handlers{
-		authService: authService,
-		translator:  translator,
-		cwClient:    cwClient,
-		logger:      logger,
+		config:     cfg,
+		accounts:   accounts,
+		translator: translator,
+		cwClient:   cwClient,
+		traffic:    recorder,
+		tracer:     tracer,
+		queue:      queue.New(cfg.Queue),
+		logger:     logger,
+		metrics:    newProxyMetrics(),
 	}
 }
 
 func (h *Handlers) MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
 	if r.Method != http.MethodPost {
-		h.logger.Error("Unsupported method: %s", r.Method)
+		h.logger.ErrorContext(ctx, "Unsupported method", "method", r.Method)
 		http.Error(w, "Only POST requests are supported", http.StatusMethodNotAllowed)
 		return
 	}
 
-	token, err := h.authService.GetToken()
-	if err != nil {
-		h.logger.Error("Failed to get token: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get token: %v", err), http.StatusInternalServerError)
-		return
-	}
-
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		h.logger.Error("Failed to read request body: %v", err)
+		h.logger.ErrorContext(ctx, "Failed to read request body", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
 
-	h.logger.Debug("Anthropic request body:\n%s", string(body))
+	// The body is in memory now. Clear the read deadline so it cannot
+	// cancel the request while a long response is still streaming.
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	h.logger.DebugContext(ctx, "Anthropic request", "bytes", len(body))
+	rec := h.traffic.Start(client.RequestIDFrom(ctx))
+	defer rec.Close()
+	rec.Request(r.Header, body)
 
 	var anthropicReq types.AnthropicRequest
 	if err := json.Unmarshal(body, &anthropicReq); err != nil {
-		h.logger.Error("Failed to parse request body: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to parse request body: %v", err), http.StatusBadRequest)
+		h.logger.WarnContext(ctx, "Failed to parse request body", "error", err)
+		writeAPIError(w, http.StatusBadRequest, errInvalidRequest, fmt.Sprintf("Failed to parse request body: %v", err))
+		return
+	}
+	if err := anthropicReq.Validate(); err != nil {
+		h.logger.WarnContext(ctx, "Invalid request", "model", anthropicReq.Model, "error", err)
+		writeAPIError(w, http.StatusBadRequest, errInvalidRequest, err.Error())
 		return
 	}
 
+	setRequestModel(ctx, anthropicReq.Model, anthropicReq.Stream)
+	tracing.SpanFrom(ctx).SetAttributes("gen_ai.request.model", anthropicReq.Model, "kiro2cc.stream", anthropicReq.Stream)
+	ctx = logging.With(ctx, "model", anthropicReq.Model, "stream", anthropicReq.Stream)
 	if anthropicReq.Stream {
-		h.handleStreamRequest(w, &anthropicReq, token.AccessToken)
+		h.handleStreamRequest(ctx, w, &anthropicReq, rec)
 		return
 	}
 
-	h.handleNonStreamRequest(w, &anthropicReq, token.AccessToken)
+	h.handleNonStreamRequest(ctx, w, &anthropicReq, rec)
 }
 
-func (h *Handlers) handleStreamRequest(w http.ResponseWriter, anthropicReq *types.AnthropicRequest, accessToken string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// clientCancelled reports whether the client went away, logging it once
+// so cancelled requests are not mistaken for upstream failures.
+func (h *Handlers) clientCancelled(ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	h.logger.InfoContext(ctx, "Client cancelled the request, aborted upstream call")
+	return true
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+func (h *Handlers) handleStreamRequest(ctx context.Context, w http.ResponseWriter, anthropicReq *types.AnthropicRequest, rec *traffic.Recording) {
+	started := time.Now()
+	h.metrics.activeStreams.Inc()
+	defer h.metrics.activeStreams.Dec()
+
+	deadline := started.Add(h.config.Server.MaxStreamDuration.Duration)
+	stream := newSSEStream(w, h.config.Server.WriteTimeout.Duration, deadline, rec, h.metrics.streamEvents)
+	inputTokens, outputTokens := 0, 0
+	defer func() { setRequestUsage(ctx, inputTokens, outputTokens, stream.errType) }()
+	if err := stream.start(); err != nil {
+		h.logger.ErrorContext(ctx, "Failed to start stream", "error", err)
 		return
 	}
 
-	messageId := fmt.Sprintf("msg_%s", time.Now().Format("20060102150405"))
+	messageId := newID("msg_")
 
-	cwReq, err := h.translator.ToCodeWhisperer(anthropicReq)
+	cwReq, err := h.translate(ctx, anthropicReq)
 	if err != nil {
-		h.sendErrorEvent(w, flusher, "Translation failed", err)
+		if h.clientCancelled(ctx) {
+			return
+		}
+		stream.sendError(errOverloaded, fmt.Sprintf("Translation failed: %v", err))
 		return
 	}
+	inputTokens = estimateInputTokens(cwReq)
 
-	resp, err := h.cwClient.SendRequest(cwReq, accessToken, true)
-	if err != nil {
-		h.sendErrorEvent(w, flusher, "CodeWhisperer request error", err)
+	if err := h.startMessage(stream, messageId, anthropicReq, inputTokens); err != nil {
+		h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
 		return
 	}
+
+	pings, stopPings := pingTicker(h.config.Server.PingInterval.Duration)
+	defer stopPings()
+	expired := time.NewTimer(time.Until(deadline))
+	defer expired.Stop()
+
+	// Wait for upstream to answer, keeping the client connection alive.
+	answered := make(chan upstreamResult, 1)
+	go func() {
+		resp, account, err := h.sendUpstream(ctx, anthropicReq, cwReq, true, rec)
+		answered <- upstreamResult{resp, account, err}
+	}()
+
+	var result upstreamResult
+	for waiting := true; waiting; {
+		select {
+		case result = <-answered:
+			waiting = false
+		case <-ctx.Done():
+			h.clientCancelled(ctx)
+			go discardUpstream(answered)
+			return
+		case <-pings:
+			if err := stream.ping(); err != nil {
+				h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
+				go discardUpstream(answered)
+				return
+			}
+		case <-expired.C:
+			stream.sendError(errAPI, "Stream exceeded the maximum duration")
+			go discardUpstream(answered)
+			return
+		}
+	}
+
+	if result.err != nil {
+		if h.clientCancelled(ctx) {
+			return
+		}
+		if throttled, ok := result.err.(*throttledError); ok {
+			stream.sendError(errRateLimit, throttled.Error())
+			return
+		}
+		if isQueueError(result.err) {
+			stream.sendError(errOverloaded, result.err.Error())
+			return
+		}
+		stream.sendError(errOverloaded, fmt.Sprintf("CodeWhisperer request error: %v", result.err))
+		return
+	}
+	resp, account := result.resp, result.account
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		h.logger.Error("CodeWhisperer response error, status: %d, response: %s", resp.StatusCode, string(body))
+		rec.UpstreamFrame(resp.StatusCode, body)
+		h.logger.ErrorContext(ctx, "CodeWhisperer response error", "account", account.Name, "status", resp.StatusCode, "response", string(body))
 
 		if resp.StatusCode == 403 {
-			if err := h.authService.RefreshToken(); err != nil {
-				h.logger.Error("Failed to refresh token: %v", err)
+			err := account.RefreshToken()
+			h.metrics.refreshed(account.Name, err)
+			if err != nil {
+				h.logger.ErrorContext(ctx, "Failed to refresh token", "account", account.Name, "error", err)
 			}
-			h.sendErrorEvent(w, flusher, "error", fmt.Errorf("CodeWhisperer Token refreshed, please retry"))
+			stream.sendError(errOverloaded, "CodeWhisperer Token refreshed, please retry")
 		} else {
-			h.sendErrorEvent(w, flusher, "error", fmt.Errorf("CodeWhisperer Error: %s", string(body)))
+			stream.sendError(errOverloaded, fmt.Sprintf("CodeWhisperer Error: %s", string(body)))
 		}
 		return
 	}
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		h.sendErrorEvent(w, flusher, "error", fmt.Errorf("Failed to read response"))
+	// Frames are decoded on their own goroutine so that pings can still be
+	// sent while upstream is quiet.
+	type frame struct {
+		events []parser.SSEEvent
+		err    error
+	}
+	frames := make(chan frame)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		_, span := h.tracer.Start(ctx, "parse_frames", tracing.KindInternal)
+		defer span.End()
+		frameCount := 0
+		defer func() { span.SetAttributes("kiro2cc.frames", frameCount) }()
+
+		decoder := parser.NewDecoder(resp.Body)
+		for {
+			events, err := decoder.Next()
+			if err == nil {
+				if frameCount == 0 {
+					span.AddEvent("first_frame")
+				}
+				frameCount++
+				rec.UpstreamFrame(0, decoder.Payload())
+			} else if err != io.EOF {
+				span.RecordError(err)
+			}
+			select {
+			case frames <- frame{events, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	_, emitSpan := h.tracer.Start(ctx, "stream_response", tracing.KindInternal)
+	defer emitSpan.End()
+	defer func() { emitSpan.SetAttributes("kiro2cc.output_tokens", outputTokens) }()
+
+	contentBlockStart := map[string]any{
+		"content_block": map[string]any{
+			"text": "",
+			"type": "text",
+		},
+		"index": 0,
+		"type":  "content_block_start",
+	}
+	if err := stream.send("content_block_start", contentBlockStart); err != nil {
+		h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
+		emitSpan.RecordError(err)
 		return
 	}
 
-	events := parser.ParseEvents(respBody)
+	firstToken := true
+	send := func(e parser.SSEEvent) error {
+		if err := stream.send(e.Event, e.Data); err != nil {
+			return err
+		}
+		if e.Event == "content_block_delta" && firstToken {
+			firstToken = false
+			h.metrics.timeToFirstToken.Observe(time.Since(started).Seconds(), anthropicReq.Model)
+			emitSpan.AddEvent("first_token")
+		}
+		return nil
+	}
+
+	// Text is held back while it could be the start of a stop sequence,
+	// and the output is cut once it reaches max_tokens. Closing the
+	// response body on return aborts the upstream call.
+	stop := stopseq.NewScanner(anthropicReq.StopSequences)
+	budget := tokens.NewCounter(anthropicReq.MaxTokens)
+	toolCalls := &toolCallFilter{choice: anthropicReq.ToolChoice}
+	toolOpen := false
+	// sendText sends as much of text as fits in the budget and reports
+	// whether the budget ran out.
+	sendText := func(text string) (bool, error) {
+		fits, full := budget.Take(text)
+		outputTokens = budget.Count()
+		if fits == "" {
+			return full, nil
+		}
+		return full, send(textDeltaEvent(fits))
+	}
+	finish := func(stopReason, stopSequence string) {
+		if toolOpen {
+			stream.send("content_block_stop", map[string]any{"index": 1, "type": "content_block_stop"})
+		}
+		h.finishMessage(stream, stopReason, stopSequence, outputTokens)
+	}
+
+	for {
+		select {
+		case f := <-frames:
+			if f.err == io.EOF {
+				full, err := sendText(stop.Flush())
+				if err != nil {
+					h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
+					return
+				}
+				switch {
+				case full:
+					finish("max_tokens", "")
+				case toolCalls.calls > 0:
+					finish("tool_use", "")
+				default:
+					if requiresToolCall(anthropicReq.ToolChoice) {
+						h.toolChoiceViolated(ctx, anthropicReq.ToolChoice, "missing_call")
+					}
+					finish("end_turn", "")
+				}
+				return
+			}
+			if f.err != nil {
+				if h.clientCancelled(ctx) {
+					return
+				}
+				h.logger.ErrorContext(ctx, "Failed to read CodeWhisperer stream", "error", f.err)
+				stream.sendError(errAPI, "Failed to read response")
+				return
+			}
+			for _, e := range f.events {
+				// Upstream ends each tool call with a tool_use stop reason,
+				// even for calls withheld here. The stop reason is sent once
+				// the stream ends, from the calls that were passed on.
+				if e.Event == "message_delta" {
+					continue
+				}
+				if toolCalls.drop(e) {
+					if e.Event == "content_block_start" {
+						h.toolChoiceViolated(ctx, anthropicReq.ToolChoice, "disallowed_call")
+					}
+					continue
+				}
+				var full bool
+				var err error
+				if text, ok := textDelta(e); ok {
+					emit, stopped := stop.Feed(text)
+					if full, err = sendText(emit); err == nil && stopped && !full {
+						h.logger.DebugContext(ctx, "Stop sequence matched, aborting upstream", "stop_sequence", stop.Matched())
+						finish("stop_sequence", stop.Matched())
+						return
+					}
+				} else if full, err = sendText(stop.Flush()); err == nil && !full {
+					if input, ok := jsonDelta(e); ok && !budget.TakeAll(input) {
+						full = true
+					} else {
+						outputTokens = budget.Count()
+						err = send(e)
+						// Only tool calls have their own blocks.
+						switch e.Event {
+						case "content_block_start":
+							toolOpen = true
+						case "content_block_stop":
+							toolOpen = false
+						}
+					}
+				}
+				if err != nil {
+					h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
+					return
+				}
+				if full {
+					h.logger.DebugContext(ctx, "Reached max_tokens, aborting upstream", "max_tokens", anthropicReq.MaxTokens)
+					finish("max_tokens", "")
+					return
+				}
+			}
+		case <-ctx.Done():
+			h.clientCancelled(ctx)
+			return
+		case <-pings:
+			if err := stream.ping(); err != nil {
+				h.logger.ErrorContext(ctx, "Failed to write stream", "error", err)
+				return
+			}
+		case <-expired.C:
+			stream.sendError(errAPI, "Stream exceeded the maximum duration")
+			return
+		}
+	}
+}
+
+type upstreamResult struct {
+	resp    *http.Response
+	account *auth.Account
+	err     error
+}
 
-	if len(events) > 0 {
-		h.sendStreamingEvents(w, flusher, events, messageId, anthropicReq)
+// discardUpstream closes the response of an upstream call whose client
+// has already gone away.
+func discardUpstream(answered <-chan upstreamResult) {
+	if result := <-answered; result.resp != nil {
+		result.resp.Body.Close()
 	}
 }
 
-func (h *Handlers) sendStreamingEvents(w http.ResponseWriter, flusher http.Flusher, events []parser.SSEEvent, messageId string, anthropicReq *types.AnthropicRequest) {
+// estimateInputTokens estimates the input tokens of a request from what is
+// sent upstream, since CodeWhisperer does not report usage.
+func estimateInputTokens(cwReq *types.CodeWhispererRequest) int {
+	body, err := json.Marshal(cwReq.ConversationState)
+	if err != nil {
+		return 0
+	}
+	return tokens.Estimate(string(body))
+}
+
+func (h *Handlers) startMessage(stream *sseStream, messageId string, anthropicReq *types.AnthropicRequest, inputTokens int) error {
 	messageStart := map[string]any{
 		"type": "message_start",
 		"message": map[string]any{
@@ -148,68 +440,74 @@ func (h *Handlers) sendStreamingEvents(w http.ResponseWriter, flusher http.Flush
 			"stop_reason":   nil,
 			"stop_sequence": nil,
 			"usage": map[string]any{
-				"input_tokens":  1,
+				"input_tokens":  inputTokens,
 				"output_tokens": 1,
 			},
 		},
 	}
-	h.sendSSEEvent(w, flusher, "message_start", messageStart)
-	h.sendSSEEvent(w, flusher, "ping", map[string]string{"type": "ping"})
-
-	contentBlockStart := map[string]any{
-		"content_block": map[string]any{
-			"text": "",
-			"type": "text",
-		},
-		"index": 0,
-		"type":  "content_block_start",
-	}
-	h.sendSSEEvent(w, flusher, "content_block_start", contentBlockStart)
-
-	outputTokens := 0
-	for _, e := range events {
-		h.sendSSEEvent(w, flusher, e.Event, e.Data)
-		if e.Event == "content_block_delta" {
-			outputTokens++
-		}
-		time.Sleep(time.Duration(rand.Intn(300)) * time.Millisecond)
+	if err := stream.send("message_start", messageStart); err != nil {
+		return err
 	}
+	return stream.ping()
+}
 
+// finishMessage ends the message. stopSequence is the stop sequence that
+// ended it, if any.
+func (h *Handlers) finishMessage(stream *sseStream, stopReason, stopSequence string, outputTokens int) {
 	contentBlockStop := map[string]any{
 		"index": 0,
 		"type":  "content_block_stop",
 	}
-	h.sendSSEEvent(w, flusher, "content_block_stop", contentBlockStop)
+	stream.send("content_block_stop", contentBlockStop)
 
 	messageDelta := map[string]any{
 		"type": "message_delta",
 		"delta": map[string]any{
-			"stop_reason":   "end_turn",
-			"stop_sequence": nil,
+			"stop_reason":   stopReason,
+			"stop_sequence": nullable(stopSequence),
 		},
 		"usage": map[string]any{
 			"output_tokens": outputTokens,
 		},
 	}
-	h.sendSSEEvent(w, flusher, "message_delta", messageDelta)
+	stream.send("message_delta", messageDelta)
 
 	messageStop := map[string]any{
 		"type": "message_stop",
 	}
-	h.sendSSEEvent(w, flusher, "message_stop", messageStop)
+	stream.send("message_stop", messageStop)
 }
 
-func (h *Handlers) handleNonStreamRequest(w http.ResponseWriter, anthropicReq *types.AnthropicRequest, accessToken string) {
-	cwReq, err := h.translator.ToCodeWhisperer(anthropicReq)
+func (h *Handlers) handleNonStreamRequest(ctx context.Context, w http.ResponseWriter, anthropicReq *types.AnthropicRequest, rec *traffic.Recording) {
+	// Upstream may take longer than WriteTimeout to produce a full answer.
+	deadline := time.Now().Add(h.config.Server.MaxStreamDuration.Duration)
+	http.NewResponseController(w).SetWriteDeadline(deadline)
+
+	cwReq, err := h.translate(ctx, anthropicReq)
 	if err != nil {
-		h.logger.Error("Translation failed: %v", err)
+		if h.clientCancelled(ctx) {
+			return
+		}
+		h.logger.ErrorContext(ctx, "Translation failed", "error", err)
 		http.Error(w, fmt.Sprintf("Translation failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := h.cwClient.SendRequest(cwReq, accessToken, false)
+	resp, _, err := h.sendUpstream(ctx, anthropicReq, cwReq, false, rec)
 	if err != nil {
-		h.logger.Error("Failed to send request: %v", err)
+		if h.clientCancelled(ctx) {
+			return
+		}
+		h.logger.ErrorContext(ctx, "Failed to send request", "error", err)
+		if throttled, ok := err.(*throttledError); ok {
+			setThrottledHeaders(w.Header(), throttled.until, time.Now())
+			writeAPIError(w, http.StatusTooManyRequests, errRateLimit, throttled.Error())
+			return
+		}
+		if isQueueError(err) {
+			writeAPIError(w, statusOverloaded, errOverloaded, err.Error())
+			return
+		}
 		http.Error(w, fmt.Sprintf("Failed to send request: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -217,42 +515,265 @@ func (h *Handlers) handleNonStreamRequest(w http.ResponseWriter, anthropicReq *t
 
 	cwRespBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		h.logger.Error("Failed to read response: %v", err)
+		if h.clientCancelled(ctx) {
+			return
+		}
+		h.logger.ErrorContext(ctx, "Failed to read response", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to read response: %v", err), http.StatusInternalServerError)
 		return
 	}
+	recordFrames(rec, resp.StatusCode, cwRespBody)
 
+	_, parseSpan := h.tracer.Start(ctx, "parse_frames", tracing.KindInternal)
 	anthropicResp, err := h.translator.FromCodeWhisperer(cwRespBody, anthropicReq.Model)
+	parseSpan.RecordError(err)
+	parseSpan.End()
 	if err != nil {
-		h.logger.Error("Translation from CodeWhisperer failed: %v", err)
+		h.logger.ErrorContext(ctx, "Translation from CodeWhisperer failed", "error", err)
 		http.Error(w, fmt.Sprintf("Translation failed: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	anthropicResp["id"] = newID("msg_")
+	dropped, calls := applyToolChoice(anthropicResp, anthropicReq.ToolChoice)
+	if dropped > 0 {
+		h.toolChoiceViolated(ctx, anthropicReq.ToolChoice, "disallowed_call")
+	}
+	if calls == 0 && requiresToolCall(anthropicReq.ToolChoice) {
+		h.toolChoiceViolated(ctx, anthropicReq.ToolChoice, "missing_call")
+	}
+	applyStopSequences(anthropicResp, anthropicReq.StopSequences)
+	applyMaxTokens(anthropicResp, anthropicReq.MaxTokens)
+	if u, ok := anthropicResp["usage"].(map[string]any); ok {
+		in := estimateInputTokens(cwReq)
+		u["input_tokens"] = in
+		out, _ := u["output_tokens"].(int)
+		setRequestUsage(ctx, in, out, "")
+	}
+
+	respBody, err := json.Marshal(anthropicResp)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "Failed to encode response", "error", err)
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rec.Response(http.StatusOK, respBody)
+
+	setRateLimitHeaders(w.Header(), resp.Header, time.Now())
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(anthropicResp)
+	w.Write(append(respBody, '\n'))
 }
 
-func (h *Handlers) sendSSEEvent(w http.ResponseWriter, flusher http.Flusher, eventType string, data any) {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
+// toolChoiceViolated records a response that did not follow tool_choice.
+func (h *Handlers) toolChoiceViolated(ctx context.Context, choice *types.AnthropicToolChoice, violation string) {
+	h.metrics.toolChoice.Inc(choice.Type, violation)
+	h.logger.WarnContext(ctx, "Response did not follow tool_choice", "tool_choice", choice.Type, "violation", violation)
+}
+
+// recordFrames records each frame of a buffered upstream response.
+func recordFrames(rec *traffic.Recording, status int, body []byte) {
+	if rec == nil {
 		return
 	}
+	if status != http.StatusOK {
+		rec.UpstreamFrame(status, body)
+		return
+	}
+	decoder := parser.NewDecoder(bytes.NewReader(body))
+	for {
+		if _, err := decoder.Next(); err != nil {
+			return
+		}
+		rec.UpstreamFrame(0, decoder.Payload())
+	}
+}
+
+// sendUpstream waits for a free upstream slot and sends the request. The
+// slot is held until the response body is closed.
+func (h *Handlers) sendUpstream(ctx context.Context, anthropicReq *types.AnthropicRequest, cwReq *types.CodeWhispererRequest, stream bool, rec *traffic.Recording) (*http.Response, *auth.Account, error) {
+	release, err := h.waitForSlot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, account, err := h.sendWithFailover(ctx, anthropicReq, cwReq, stream, rec)
+	if err != nil {
+		release()
+		return nil, account, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, account, nil
+}
 
-	fmt.Fprintf(w, "event: %s\n", eventType)
-	fmt.Fprintf(w, "data: %s\n\n", string(jsonData))
-	flusher.Flush()
+// waitForSlot queues the request for one of the upstream slots, ahead of
+// requests from keys with a lower priority.
+func (h *Handlers) waitForSlot(ctx context.Context) (func(), error) {
+	if h.queue == nil {
+		return func() {}, nil
+	}
+	started := time.Now()
+	release, err := h.queue.Acquire(ctx, h.priority(ctx))
+	waited := time.Since(started)
+	h.metrics.queueWait.Observe(waited.Seconds())
+	tracing.SpanFrom(ctx).SetAttributes("kiro2cc.queue_wait_ms", waited.Milliseconds())
+	switch {
+	case errors.Is(err, queue.ErrFull):
+		h.metrics.queueRejected.Inc("full")
+		h.logger.WarnContext(ctx, "Upstream queue is full, rejecting request")
+	case errors.Is(err, queue.ErrTimeout):
+		h.metrics.queueRejected.Inc("timeout")
+		h.logger.WarnContext(ctx, "Request timed out in the upstream queue", "waited", waited.String())
+	case err == nil && waited >= time.Second:
+		h.logger.InfoContext(ctx, "Request waited for a free upstream slot", "waited", waited.String())
+	}
+	return release, err
 }
 
-func (h *Handlers) sendErrorEvent(w http.ResponseWriter, flusher http.Flusher, message string, err error) {
-	errorResp := map[string]any{
-		"type": "error",
-		"error": map[string]any{
-			"type":    "overloaded_error",
-			"message": message,
-		},
+// priority returns the queue priority configured for the request's API
+// key, by ID or name.
+func (h *Handlers) priority(ctx context.Context) int {
+	key := apikeys.FromContext(ctx)
+	if key == nil {
+		return 0
+	}
+	if p, ok := h.config.Queue.Priorities[key.ID]; ok {
+		return p
+	}
+	return h.config.Queue.Priorities[key.Name]
+}
+
+// isQueueError reports whether err means the request never got an
+// upstream slot.
+func isQueueError(err error) bool {
+	return errors.Is(err, queue.ErrFull) || errors.Is(err, queue.ErrTimeout)
+}
+
+// releasingBody frees the request's upstream slot when it is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// sendWithFailover sends the request with an account chosen by the pool,
+// failing over to the next account when upstream reports throttling or
+// quota exhaustion. Any other response is returned to the caller as is.
+func (h *Handlers) sendWithFailover(ctx context.Context, anthropicReq *types.AnthropicRequest, cwReq *types.CodeWhispererRequest, stream bool, rec *traffic.Recording) (*http.Response, *auth.Account, error) {
+	key := conversationKey(anthropicReq)
+	tried := make(map[string]bool)
+	var lastErr error
+	// retryReason says why the previous account failed, if one did.
+	retryReason := ""
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		account, err := h.accounts.Select(key, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, err
+		}
+		tried[account.Name] = true
+		if retryReason != "" {
+			h.metrics.upstreamRetries.Inc(retryReason)
+		}
+
+		token, err := account.GetToken()
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Failed to get token", "account", account.Name, "error", err)
+			lastErr = fmt.Errorf("failed to get token: %w", err)
+			retryReason = "token"
+			continue
+		}
+
+		profileArn, err := account.ProfileFor(token)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "Account is misconfigured", "account", account.Name, "error", err)
+			lastErr = err
+			retryReason = "profile"
+			continue
+		}
+		cwReq.ProfileArn = profileArn
+		if rec != nil {
+			body, _ := json.Marshal(cwReq)
+			rec.UpstreamRequest(account.Name, body)
+		}
+
+		sent := time.Now()
+		resp, err := h.callUpstream(ctx, cwReq, token.AccessToken, account, stream)
+		if err != nil {
+			h.metrics.observeUpstream(account.Name, 0, sent)
+			return nil, account, err
+		}
+		h.metrics.observeUpstream(account.Name, resp.StatusCode, sent)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			account.ForgetToken()
+		}
+		h.logger.DebugContext(ctx, "CodeWhisperer responded",
+			"account", account.Name,
+			"status", resp.StatusCode,
+			"upstream_request_id", resp.Header.Get("x-amzn-requestid"))
+		if resp.StatusCode == http.StatusOK {
+			return resp, account, nil
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !isThrottled(resp.StatusCode, body) {
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			return resp, account, nil
+		}
+
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		h.accounts.MarkThrottled(account, retryAfter)
+		h.logger.WarnContext(ctx, "Account throttled by CodeWhisperer, failing over", "account", account.Name, "status", resp.StatusCode)
+
+		until := h.accounts.ThrottledUntil(account)
+		if throttled, ok := lastErr.(*throttledError); ok && throttled.until.Before(until) {
+			until = throttled.until
+		}
+		lastErr = &throttledError{status: resp.StatusCode, body: string(body), until: until}
+		retryReason = "throttled"
+	}
+}
+
+// translate converts the request for CodeWhisperer within its own span.
+func (h *Handlers) translate(ctx context.Context, anthropicReq *types.AnthropicRequest) (*types.CodeWhispererRequest, error) {
+	ctx, span := h.tracer.Start(ctx, "translate_request", tracing.KindInternal)
+	defer span.End()
+	cwReq, err := h.translator.ToCodeWhisperer(ctx, anthropicReq)
+	span.RecordError(err)
+	return cwReq, err
+}
+
+// callUpstream sends one request to CodeWhisperer within a client span,
+// which ends once the response headers arrive.
+func (h *Handlers) callUpstream(ctx context.Context, cwReq *types.CodeWhispererRequest, accessToken string, account *auth.Account, stream bool) (*http.Response, error) {
+	ctx, span := h.tracer.Start(ctx, "codewhisperer.generateAssistantResponse", tracing.KindClient,
+		"kiro2cc.account", account.Name,
+		"cloud.region", account.Region())
+	defer span.End()
+
+	resp, err := h.cwClient.SendRequest(ctx, cwReq, accessToken, account.Region(), stream)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(
+		"http.response.status_code", resp.StatusCode,
+		"aws.request_id", resp.Header.Get("x-amzn-requestid"))
+	if resp.StatusCode != http.StatusOK {
+		span.SetError(resp.Status)
 	}
-	h.sendSSEEvent(w, flusher, "error", errorResp)
+	return resp, nil
 }
 
 func (h *Handlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
@@ -261,7 +782,6 @@ func (h *Handlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handlers) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	h.logger.Info("Access to unknown endpoint: %s", r.URL.Path)
+	h.logger.InfoContext(r.Context(), "Access to unknown endpoint", "path", r.URL.Path)
 	http.Error(w, "404 Not Found", http.StatusNotFound)
 }
-
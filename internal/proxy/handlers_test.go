@@ -0,0 +1,503 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/auth"
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/translator"
+	"github.com/shyn/kiro2cc/internal/usage"
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+// fakeUpstream answers every CodeWhisperer call with the same frames,
+// written one at a time so that closing the response body stops it.
+type fakeUpstream struct {
+	payloads []string
+
+	mu       sync.Mutex
+	requests []*types.CodeWhispererRequest
+	// sent receives how many frames the last response wrote before it
+	// ended or its body was closed.
+	sent chan int
+}
+
+func (f *fakeUpstream) SendRequest(ctx context.Context, req *types.CodeWhispererRequest, accessToken, region string, stream bool) (*http.Response, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+
+	r, w := io.Pipe()
+	go func() {
+		n := 0
+		for _, payload := range f.payloads {
+			if _, err := w.Write(eventFrame(payload)); err != nil {
+				break
+			}
+			n++
+		}
+		w.Close()
+		f.sent <- n
+	}()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: r}, nil
+}
+
+// framesSent returns how many frames the last response wrote.
+func (f *fakeUpstream) framesSent(t *testing.T) int {
+	t.Helper()
+	select {
+	case n := <-f.sent:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream response was never finished or closed")
+		return 0
+	}
+}
+
+func (f *fakeUpstream) ListAvailableProfiles(accessToken, region string) ([]types.Profile, error) {
+	return nil, nil
+}
+
+func (f *fakeUpstream) lastRequest(t *testing.T) *types.CodeWhispererRequest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		t.Fatal("no request reached upstream")
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// eventFrame wraps payload in an event-stream frame without headers.
+func eventFrame(payload string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(16+len(payload)))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	buf.WriteString(payload)
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	return buf.Bytes()
+}
+
+type testProxy struct {
+	url        string
+	upstream   *fakeUpstream
+	ledgerPath string
+}
+
+// newTestProxy serves the proxy in front of a fake upstream sending
+// payloads, with API keys disabled and a usage ledger. configure may
+// adjust the config first.
+func newTestProxy(t *testing.T, configure func(*config.Config), payloads ...string) *testProxy {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	cfg, err := config.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Server.RequireAPIKey = false
+	cfg.Auth.SecretStore = config.StorePlaintext
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := os.WriteFile(cfg.Auth.TokenFilePath, []byte(`{"accessToken":"a","refreshToken":"r"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ledgerPath := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger, err := usage.Open(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	upstream := &fakeUpstream{payloads: payloads, sent: make(chan int, 16)}
+	handlers := NewHandlers(cfg, auth.NewPool(cfg), translator.NewService(cfg), upstream, nil, nil, logger)
+	server := httptest.NewServer(NewServer(cfg, handlers, nil, ledger, logger).routes())
+	t.Cleanup(server.Close)
+	return &testProxy{url: server.URL, upstream: upstream, ledgerPath: ledgerPath}
+}
+
+// post sends a Messages request and returns the response with its body
+// read.
+func (p *testProxy) post(t *testing.T, body string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(p.url+"/v1/messages", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	return resp, data
+}
+
+func (p *testProxy) records(t *testing.T) []usage.Record {
+	t.Helper()
+	records, err := usage.Read(p.ledgerPath, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+type sseEvent struct {
+	name string
+	data map[string]any
+}
+
+// parseSSE splits a stream body into its events, leaving out pings.
+func parseSSE(t *testing.T, body []byte) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.data); err != nil {
+				t.Fatalf("event %s: %v", current.name, err)
+			}
+		case line == "":
+			if current.name != "" && current.name != "ping" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestStreamUsageEstimatesInputTokens(t *testing.T) {
+	p := newTestProxy(t, nil, `{"content":"Hello"}`, `{"content":" world"}`)
+	prompt := strings.Repeat("Summarize the quarterly report in three bullet points. ", 20)
+	_, body := p.post(t, `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":true,
+		"messages":[{"role":"user","content":"`+prompt+`"}]}`)
+
+	want := estimateInputTokens(p.upstream.lastRequest(t))
+	if want < 200 {
+		t.Fatalf("estimate %d is too low for a %d character prompt", want, len(prompt))
+	}
+
+	events := parseSSE(t, body)
+	if len(events) == 0 || events[0].name != "message_start" {
+		t.Fatalf("stream does not begin with message_start: %s", body)
+	}
+	message, _ := events[0].data["message"].(map[string]any)
+	reported, _ := message["usage"].(map[string]any)
+	if got, _ := reported["input_tokens"].(float64); int(got) != want {
+		t.Fatalf("message_start reported %v input tokens, want %d", reported["input_tokens"], want)
+	}
+
+	records := p.records(t)
+	if len(records) != 1 {
+		t.Fatalf("ledger has %d records, want 1", len(records))
+	}
+	if records[0].InputTokens != want || records[0].OutputTokens != 3 {
+		t.Fatalf("ledger recorded %d input and %d output tokens, want %d and 3",
+			records[0].InputTokens, records[0].OutputTokens, want)
+	}
+}
+
+func TestNonStreamUsageEstimatesInputTokens(t *testing.T) {
+	p := newTestProxy(t, nil, `{"content":"Hello"}`)
+	_, body := p.post(t, `{"model":"claude-sonnet-4-20250514","max_tokens":100,
+		"messages":[{"role":"user","content":"Tell me about the weather in Paris today, please."}]}`)
+
+	want := estimateInputTokens(p.upstream.lastRequest(t))
+	var resp struct {
+		Usage struct {
+			InputTokens int `json:"input_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Usage.InputTokens != want {
+		t.Fatalf("response reported %d input tokens, want %d", resp.Usage.InputTokens, want)
+	}
+	if records := p.records(t); len(records) != 1 || records[0].InputTokens != want {
+		t.Fatalf("ledger = %+v, want one record with %d input tokens", records, want)
+	}
+}
+
+func TestStreamChargesInputTokens(t *testing.T) {
+	const limit = 1000000
+	p := newTestProxy(t, func(cfg *config.Config) {
+		cfg.RateLimit.Global.TokensPerDay = limit
+	}, `{"content":"ok"}`)
+	request := `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":true,
+		"messages":[{"role":"user","content":"` + strings.Repeat("Explain the build failure. ", 30) + `"}]}`
+
+	p.post(t, request)
+	input := estimateInputTokens(p.upstream.lastRequest(t))
+
+	resp, _ := p.post(t, request)
+	remaining, err := strconv.Atoi(resp.Header.Get("anthropic-ratelimit-tokens-remaining"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining > limit-input {
+		t.Fatalf("%d tokens remaining after a stream with %d input tokens, want at most %d", remaining, input, limit-input)
+	}
+}
+
+// weatherCall is what upstream sends for one call to get_weather.
+var weatherCall = []string{
+	`{"content":"Checking."}`,
+	`{"name":"get_weather","toolUseId":"t1"}`,
+	`{"name":"get_weather","toolUseId":"t1","input":"{\"city\":\"Paris\"}"}`,
+	`{"name":"get_weather","toolUseId":"t1","stop":true}`,
+}
+
+func toolRequest(stream bool, choice string) string {
+	return `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":` + strconv.FormatBool(stream) + `,
+		"tools":[{"name":"get_weather","input_schema":{"type":"object"}},{"name":"search","input_schema":{"type":"object"}}],
+		"tool_choice":` + choice + `,
+		"messages":[{"role":"user","content":"Weather in Paris?"}]}`
+}
+
+func TestStreamToolChoice(t *testing.T) {
+	tests := []struct {
+		name       string
+		choice     string
+		toolBlocks int
+		stopReason string
+	}{
+		{"auto", `{"type":"auto"}`, 1, "tool_use"},
+		{"named tool", `{"type":"tool","name":"get_weather"}`, 1, "tool_use"},
+		{"other tool", `{"type":"tool","name":"search"}`, 0, "end_turn"},
+		{"none", `{"type":"none"}`, 0, "end_turn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, nil, weatherCall...)
+			_, body := p.post(t, toolRequest(true, tt.choice))
+
+			toolBlocks := 0
+			var stopReasons []any
+			for _, e := range parseSSE(t, body) {
+				switch e.name {
+				case "content_block_start":
+					if block, _ := e.data["content_block"].(map[string]any); block["type"] == "tool_use" {
+						toolBlocks++
+					}
+				case "message_delta":
+					delta, _ := e.data["delta"].(map[string]any)
+					stopReasons = append(stopReasons, delta["stop_reason"])
+				}
+			}
+			if toolBlocks != tt.toolBlocks {
+				t.Errorf("stream has %d tool_use blocks, want %d:\n%s", toolBlocks, tt.toolBlocks, body)
+			}
+			if !reflect.DeepEqual(stopReasons, []any{tt.stopReason}) {
+				t.Errorf("message_delta stop reasons = %v, want [%s]", stopReasons, tt.stopReason)
+			}
+		})
+	}
+}
+
+func TestNonStreamToolChoice(t *testing.T) {
+	tests := []struct {
+		name       string
+		choice     string
+		toolBlocks int
+		stopReason string
+	}{
+		{"auto", `{"type":"auto"}`, 1, "tool_use"},
+		{"named tool", `{"type":"tool","name":"get_weather"}`, 1, "tool_use"},
+		{"other tool", `{"type":"tool","name":"search"}`, 0, "end_turn"},
+		{"none", `{"type":"none"}`, 0, "end_turn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(t, nil, weatherCall...)
+			_, body := p.post(t, toolRequest(false, tt.choice))
+
+			var resp struct {
+				Content []struct {
+					Type string `json:"type"`
+				} `json:"content"`
+				StopReason string `json:"stop_reason"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatal(err)
+			}
+			toolBlocks := 0
+			for _, block := range resp.Content {
+				if block.Type == "tool_use" {
+					toolBlocks++
+				}
+			}
+			if toolBlocks != tt.toolBlocks || resp.StopReason != tt.stopReason {
+				t.Errorf("got %d tool_use blocks and stop_reason %s, want %d and %s:\n%s",
+					toolBlocks, resp.StopReason, tt.toolBlocks, tt.stopReason, body)
+			}
+		})
+	}
+}
+
+// streamOutcome is the text of a stream and how it ended.
+type streamOutcome struct {
+	text         string
+	stopReason   any
+	stopSequence any
+	outputTokens float64
+}
+
+func outcomeOf(t *testing.T, body []byte) streamOutcome {
+	t.Helper()
+	var out streamOutcome
+	deltas := 0
+	for _, e := range parseSSE(t, body) {
+		switch e.name {
+		case "content_block_delta":
+			if delta, _ := e.data["delta"].(map[string]any); delta["type"] == "text_delta" {
+				out.text += delta["text"].(string)
+			}
+		case "message_delta":
+			deltas++
+			delta, _ := e.data["delta"].(map[string]any)
+			usage, _ := e.data["usage"].(map[string]any)
+			out.stopReason, out.stopSequence = delta["stop_reason"], delta["stop_sequence"]
+			out.outputTokens, _ = usage["output_tokens"].(float64)
+		}
+	}
+	if deltas != 1 {
+		t.Fatalf("stream has %d message_delta events, want 1:\n%s", deltas, body)
+	}
+	return out
+}
+
+// messageOutcome is the text of a complete response and how it ended.
+func messageOutcome(t *testing.T, body []byte) streamOutcome {
+	t.Helper()
+	var resp struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason   any `json:"stop_reason"`
+		StopSequence any `json:"stop_sequence"`
+		Usage        struct {
+			OutputTokens float64 `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	out := streamOutcome{stopReason: resp.StopReason, stopSequence: resp.StopSequence, outputTokens: resp.Usage.OutputTokens}
+	for _, block := range resp.Content {
+		out.text += block.Text
+	}
+	return out
+}
+
+// repeated returns n frames of the same text.
+func repeated(text string, n int) []string {
+	frames := make([]string, n)
+	for i := range frames {
+		frames[i] = `{"content":"` + text + `"}`
+	}
+	return frames
+}
+
+func TestMaxTokens(t *testing.T) {
+	// Each frame is two tokens, so five tokens end halfway through the
+	// third frame.
+	frames := repeated("abcdefgh", 50)
+	want := streamOutcome{text: strings.Repeat("abcdefgh", 2) + "abcd", stopReason: "max_tokens", outputTokens: 5}
+
+	for _, stream := range []bool{true, false} {
+		t.Run("stream="+strconv.FormatBool(stream), func(t *testing.T) {
+			p := newTestProxy(t, nil, frames...)
+			_, body := p.post(t, `{"model":"claude-sonnet-4-20250514","max_tokens":5,"stream":`+strconv.FormatBool(stream)+`,
+				"messages":[{"role":"user","content":"hi"}]}`)
+
+			var got streamOutcome
+			if stream {
+				got = outcomeOf(t, body)
+			} else {
+				got = messageOutcome(t, body)
+			}
+			if got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+			if sent := p.upstream.framesSent(t); stream && sent >= len(frames) {
+				t.Fatalf("upstream sent all %d frames, want the call aborted", sent)
+			}
+		})
+	}
+}
+
+func TestStopSequences(t *testing.T) {
+	frames := append([]string{`{"content":"Hello "}`, `{"content":"wor"}`, `{"content":"ld EN"}`, `{"content":"D trailing"}`},
+		repeated(" more", 50)...)
+	want := streamOutcome{text: "Hello world ", stopReason: "stop_sequence", stopSequence: "END", outputTokens: 3}
+
+	for _, stream := range []bool{true, false} {
+		t.Run("stream="+strconv.FormatBool(stream), func(t *testing.T) {
+			p := newTestProxy(t, nil, frames...)
+			_, body := p.post(t, `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":`+strconv.FormatBool(stream)+`,
+				"stop_sequences":["STOP","END"],"messages":[{"role":"user","content":"hi"}]}`)
+
+			var got streamOutcome
+			if stream {
+				got = outcomeOf(t, body)
+			} else {
+				got = messageOutcome(t, body)
+			}
+			if got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+			if sent := p.upstream.framesSent(t); stream && sent >= len(frames) {
+				t.Fatalf("upstream sent all %d frames, want the call aborted", sent)
+			}
+		})
+	}
+}
+
+func TestNonStreamKeepsTextBeforeToolCalls(t *testing.T) {
+	p := newTestProxy(t, nil, weatherCall...)
+	_, body := p.post(t, toolRequest(false, `{"type":"auto"}`))
+
+	var resp struct {
+		Content []map[string]any `json:"content"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 2 || resp.Content[0]["text"] != "Checking." || resp.Content[1]["name"] != "get_weather" {
+		t.Fatalf("content = %v, want the text and then the tool call", resp.Content)
+	}
+	if input, _ := resp.Content[1]["input"].(map[string]any); input["city"] != "Paris" {
+		t.Fatalf("tool input = %v", resp.Content[1]["input"])
+	}
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+const idAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// newID returns prefix followed by 24 random base62 characters, in the
+// style of Anthropic's request and message IDs.
+func newID(prefix string) string {
+	b := make([]byte, 24)
+	max := big.NewInt(int64(len(idAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = idAlphabet[n.Int64()]
+	}
+	return prefix + string(b)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/metrics"
+	"github.com/shyn/kiro2cc/internal/version"
+)
+
+// proxyMetrics are the metrics served on GET /metrics.
+type proxyMetrics struct {
+	registry *metrics.Registry
+
+	requests         *metrics.Counter
+	requestDuration  *metrics.Histogram
+	upstreamLatency  *metrics.Histogram
+	timeToFirstToken *metrics.Histogram
+	streamEvents     *metrics.Counter
+	activeStreams    *metrics.Gauge
+	tokenRefreshes   *metrics.Counter
+	upstreamRetries  *metrics.Counter
+	rateLimited      *metrics.Counter
+	upstreamInFlight *metrics.Gauge
+	queueDepth       *metrics.Gauge
+	queueWait        *metrics.Histogram
+	queueRejected    *metrics.Counter
+	toolChoice       *metrics.Counter
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := metrics.NewRegistry()
+	m := &proxyMetrics{
+		registry: r,
+		requests: r.NewCounter("kiro2cc_http_requests_total",
+			"HTTP requests served, by route, model and response status.",
+			"route", "model", "status"),
+		requestDuration: r.NewHistogram("kiro2cc_http_request_duration_seconds",
+			"Time to serve an HTTP request, including the whole stream.",
+			metrics.DefaultBuckets, "route"),
+		upstreamLatency: r.NewHistogram("kiro2cc_upstream_request_duration_seconds",
+			"Time until CodeWhisperer answers with response headers.",
+			metrics.DefaultBuckets, "account", "status"),
+		timeToFirstToken: r.NewHistogram("kiro2cc_time_to_first_token_seconds",
+			"Time from receiving a streaming request to sending its first content delta.",
+			metrics.DefaultBuckets, "model"),
+		streamEvents: r.NewCounter("kiro2cc_stream_events_total",
+			"Server-sent events written to clients, by event type.",
+			"event"),
+		activeStreams: r.NewGauge("kiro2cc_active_streams",
+			"Streaming responses currently open."),
+		tokenRefreshes: r.NewCounter("kiro2cc_token_refreshes_total",
+			"Token refreshes after CodeWhisperer rejected a token, by result.",
+			"account", "result"),
+		upstreamRetries: r.NewCounter("kiro2cc_upstream_retries_total",
+			"Requests moved to another account, by the reason the previous one failed.",
+			"reason"),
+		rateLimited: r.NewCounter("kiro2cc_rate_limited_total",
+			"Requests rejected by the local rate limits, by scope and limit.",
+			"scope", "limit"),
+		upstreamInFlight: r.NewGauge("kiro2cc_upstream_in_flight",
+			"CodeWhisperer calls holding an upstream slot."),
+		queueDepth: r.NewGauge("kiro2cc_queue_depth",
+			"Requests waiting for an upstream slot."),
+		queueWait: r.NewHistogram("kiro2cc_queue_wait_seconds",
+			"Time requests waited for an upstream slot.",
+			metrics.DefaultBuckets),
+		queueRejected: r.NewCounter("kiro2cc_queue_rejected_total",
+			"Requests that never got an upstream slot, by reason.",
+			"reason"),
+		toolChoice: r.NewCounter("kiro2cc_tool_choice_violations_total",
+			"Responses that did not follow tool_choice, by choice and violation.",
+			"choice", "violation"),
+	}
+	r.NewGauge("kiro2cc_build_info", "Always 1, labelled with the kiro2cc version.", "version").Set(1, version.Version)
+	return m
+}
+
+// MetricsHandler serves the metrics, sampling the upstream queue first.
+func (h *Handlers) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	inFlight, waiting := h.queue.Stats()
+	h.metrics.upstreamInFlight.Set(float64(inFlight))
+	h.metrics.queueDepth.Set(float64(waiting))
+	h.metrics.registry.ServeHTTP(w, r)
+}
+
+func (m *proxyMetrics) observeUpstream(account string, status int, started time.Time) {
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	m.upstreamLatency.Observe(time.Since(started).Seconds(), account, label)
+}
+
+func (m *proxyMetrics) refreshed(account string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.tokenRefreshes.Inc(account, result)
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/shyn/kiro2cc/internal/stopseq"
+	"github.com/shyn/kiro2cc/internal/tokens"
+	"github.com/shyn/kiro2cc/parser"
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+// textDelta returns the text of a text_delta event.
+func textDelta(e parser.SSEEvent) (string, bool) {
+	if e.Event != "content_block_delta" {
+		return "", false
+	}
+	data, _ := e.Data.(map[string]any)
+	delta, _ := data["delta"].(map[string]any)
+	if delta["type"] != "text_delta" {
+		return "", false
+	}
+	text, ok := delta["text"].(string)
+	return text, ok
+}
+
+// jsonDelta returns the partial tool input of an input_json_delta event.
+func jsonDelta(e parser.SSEEvent) (string, bool) {
+	if e.Event != "content_block_delta" {
+		return "", false
+	}
+	data, _ := e.Data.(map[string]any)
+	delta, _ := data["delta"].(map[string]any)
+	if delta["type"] != "input_json_delta" {
+		return "", false
+	}
+	switch partial := delta["partial_json"].(type) {
+	case string:
+		return partial, true
+	case *string:
+		if partial != nil {
+			return *partial, true
+		}
+	}
+	return "", true
+}
+
+// textDeltaEvent is a text_delta event for the text block.
+func textDeltaEvent(text string) parser.SSEEvent {
+	return parser.SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]any{
+				"type": "text_delta",
+				"text": text,
+			},
+		},
+	}
+}
+
+// applyStopSequences cuts a complete response at the first stop sequence
+// in its text, dropping any content blocks after it.
+func applyStopSequences(resp map[string]any, seqs []string) {
+	if len(seqs) == 0 {
+		return
+	}
+	blocks, _ := resp["content"].([]map[string]any)
+	for i, block := range blocks {
+		if block["type"] != "text" {
+			continue
+		}
+		text, _ := block["text"].(string)
+		before, seq, found := stopseq.Cut(text, seqs)
+		if !found {
+			continue
+		}
+		block["text"] = before
+		resp["content"] = blocks[:i+1]
+		resp["stop_reason"] = "stop_sequence"
+		resp["stop_sequence"] = seq
+		return
+	}
+}
+
+// applyMaxTokens cuts a complete response at max_tokens, dropping a tool
+// call that does not fit whole, and reports the estimated output tokens in
+// its usage.
+func applyMaxTokens(resp map[string]any, maxTokens int) {
+	budget := tokens.NewCounter(maxTokens)
+	blocks, _ := resp["content"].([]map[string]any)
+	for i, block := range blocks {
+		switch block["type"] {
+		case "text":
+			text, _ := block["text"].(string)
+			fits, full := budget.Take(text)
+			block["text"] = fits
+			if full {
+				resp["content"] = blocks[:i+1]
+				resp["stop_reason"] = "max_tokens"
+			}
+		case "tool_use":
+			input, _ := json.Marshal(block["input"])
+			if !budget.TakeAll(string(input)) {
+				resp["content"] = blocks[:i]
+				resp["stop_reason"] = "max_tokens"
+			}
+		}
+		if resp["stop_reason"] == "max_tokens" {
+			resp["stop_sequence"] = nil
+			break
+		}
+	}
+	if usage, ok := resp["usage"].(map[string]any); ok {
+		usage["output_tokens"] = budget.Count()
+	}
+}
+
+// allowsToolCall reports whether tool_choice permits a call to the named
+// tool after calls earlier ones in the same response.
+func allowsToolCall(choice *types.AnthropicToolChoice, name string, calls int) bool {
+	if choice == nil {
+		return true
+	}
+	switch {
+	case choice.Type == "none":
+		return false
+	case choice.Type == "tool" && name != choice.Name:
+		return false
+	case calls > 0 && choice.DisableParallelToolUse != nil && *choice.DisableParallelToolUse:
+		return false
+	}
+	return true
+}
+
+// requiresToolCall reports whether tool_choice demands a tool call.
+func requiresToolCall(choice *types.AnthropicToolChoice) bool {
+	return choice != nil && (choice.Type == "any" || choice.Type == "tool")
+}
+
+// toolCallFilter withholds streamed tool calls that tool_choice does not
+// allow.
+type toolCallFilter struct {
+	choice *types.AnthropicToolChoice
+	// calls counts the tool calls passed on.
+	calls    int
+	dropping bool
+}
+
+// drop reports whether e belongs to a tool call the client must not get.
+func (f *toolCallFilter) drop(e parser.SSEEvent) bool {
+	switch e.Event {
+	case "content_block_start":
+		data, _ := e.Data.(map[string]any)
+		block, _ := data["content_block"].(map[string]any)
+		name, _ := block["name"].(string)
+		f.dropping = !allowsToolCall(f.choice, name, f.calls)
+		if !f.dropping {
+			f.calls++
+		}
+		return f.dropping
+	case "content_block_delta":
+		_, isTool := jsonDelta(e)
+		return isTool && f.dropping
+	case "content_block_stop":
+		dropped := f.dropping
+		f.dropping = false
+		return dropped
+	}
+	return false
+}
+
+// applyToolChoice drops the tool calls in a complete response that
+// tool_choice does not allow, and sets stop_reason to tool_use if any are
+// left. It returns how many calls were dropped and how many remain.
+func applyToolChoice(resp map[string]any, choice *types.AnthropicToolChoice) (dropped, calls int) {
+	blocks, ok := resp["content"].([]map[string]any)
+	if !ok {
+		return 0, 0
+	}
+	kept := blocks[:0]
+	for _, block := range blocks {
+		if block["type"] == "tool_use" {
+			name, _ := block["name"].(string)
+			if !allowsToolCall(choice, name, calls) {
+				dropped++
+				continue
+			}
+			calls++
+		}
+		kept = append(kept, block)
+	}
+	resp["content"] = kept
+	if calls > 0 {
+		resp["stop_reason"] = "tool_use"
+	}
+	return dropped, calls
+}
+
+// nullable returns s, or nil to encode an empty string as null.
+func nullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
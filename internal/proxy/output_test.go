@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shyn/kiro2cc/parser"
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+func toolChoice(typ, name string, disableParallel bool) *types.AnthropicToolChoice {
+	return &types.AnthropicToolChoice{Type: typ, Name: name, DisableParallelToolUse: &disableParallel}
+}
+
+func TestApplyToolChoice(t *testing.T) {
+	tests := []struct {
+		name       string
+		choice     *types.AnthropicToolChoice
+		kept       []string
+		dropped    int
+		stopReason string
+	}{
+		{"unset", nil, []string{"text", "get_weather", "search"}, 0, "tool_use"},
+		{"auto", toolChoice("auto", "", false), []string{"text", "get_weather", "search"}, 0, "tool_use"},
+		{"any", toolChoice("any", "", false), []string{"text", "get_weather", "search"}, 0, "tool_use"},
+		{"none", toolChoice("none", "", false), []string{"text"}, 2, "end_turn"},
+		{"tool", toolChoice("tool", "search", false), []string{"text", "search"}, 1, "tool_use"},
+		{"tool not called", toolChoice("tool", "calculator", false), []string{"text"}, 2, "end_turn"},
+		{"no parallel calls", toolChoice("auto", "", true), []string{"text", "get_weather"}, 1, "tool_use"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := map[string]any{
+				"stop_reason": "end_turn",
+				"content": []map[string]any{
+					{"type": "text", "text": "Let me check."},
+					{"type": "tool_use", "id": "t1", "name": "get_weather", "input": map[string]any{}},
+					{"type": "tool_use", "id": "t2", "name": "search", "input": map[string]any{}},
+				},
+			}
+			dropped, calls := applyToolChoice(resp, tt.choice)
+
+			var kept []string
+			for _, block := range resp["content"].([]map[string]any) {
+				if block["type"] == "tool_use" {
+					kept = append(kept, block["name"].(string))
+				} else {
+					kept = append(kept, "text")
+				}
+			}
+			if !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("kept %q, want %q", kept, tt.kept)
+			}
+			if dropped != tt.dropped || calls != len(tt.kept)-1 {
+				t.Errorf("dropped %d and kept %d calls, want %d and %d", dropped, calls, tt.dropped, len(tt.kept)-1)
+			}
+			if resp["stop_reason"] != tt.stopReason {
+				t.Errorf("stop_reason = %v, want %s", resp["stop_reason"], tt.stopReason)
+			}
+		})
+	}
+}
+
+// toolCallEvents returns the events the parser produces for one tool call.
+func toolCallEvents(name string) []parser.SSEEvent {
+	input := `{"q":"x"}`
+	return []parser.SSEEvent{
+		{Event: "content_block_start", Data: map[string]any{
+			"type": "content_block_start", "index": 1,
+			"content_block": map[string]any{"type": "tool_use", "id": "t-" + name, "name": name, "input": map[string]any{}},
+		}},
+		{Event: "content_block_delta", Data: map[string]any{
+			"type": "content_block_delta", "index": 1,
+			"delta": map[string]any{"type": "input_json_delta", "partial_json": &input},
+		}},
+		{Event: "content_block_stop", Data: map[string]any{"type": "content_block_stop", "index": 1}},
+	}
+}
+
+func TestToolCallFilter(t *testing.T) {
+	text := parser.SSEEvent{Event: "content_block_delta", Data: map[string]any{
+		"type": "content_block_delta", "index": 0,
+		"delta": map[string]any{"type": "text_delta", "text": "hi"},
+	}}
+
+	tests := []struct {
+		name   string
+		choice *types.AnthropicToolChoice
+		passed []bool // for get_weather's three events, then search's
+		calls  int
+	}{
+		{"auto", toolChoice("auto", "", false), []bool{true, true, true, true, true, true}, 2},
+		{"any", toolChoice("any", "", false), []bool{true, true, true, true, true, true}, 2},
+		{"none", toolChoice("none", "", false), []bool{false, false, false, false, false, false}, 0},
+		{"tool", toolChoice("tool", "search", false), []bool{false, false, false, true, true, true}, 1},
+		{"no parallel calls", toolChoice("auto", "", true), []bool{true, true, true, false, false, false}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &toolCallFilter{choice: tt.choice}
+			var passed []bool
+			for _, e := range append(toolCallEvents("get_weather"), toolCallEvents("search")...) {
+				passed = append(passed, !f.drop(e))
+				if f.drop(text) {
+					t.Fatal("text was dropped")
+				}
+			}
+			if !reflect.DeepEqual(passed, tt.passed) {
+				t.Errorf("passed %v, want %v", passed, tt.passed)
+			}
+			if f.calls != tt.calls {
+				t.Errorf("calls = %d, want %d", f.calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/apikeys"
+	"github.com/shyn/kiro2cc/internal/ratelimit"
+)
+
+// throttledError is returned when upstream throttled every account that
+// was tried for a request.
+type throttledError struct {
+	status int
+	body   string
+	// until is when the first of those accounts comes back into rotation.
+	until time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("CodeWhisperer throttled all accounts, last status %d: %s", e.status, e.body)
+}
+
+// setThrottledHeaders tells the client when to retry a request that was
+// rejected because every account is throttled.
+func setThrottledHeaders(h http.Header, until, now time.Time) {
+	wait := until.Sub(now)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	h.Set("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	h.Set("anthropic-ratelimit-requests-remaining", "0")
+	h.Set("anthropic-ratelimit-requests-reset", now.Add(wait).UTC().Format(time.RFC3339))
+}
+
+// upstreamLimits maps the rate-limit headers upstream may send to the
+// Anthropic headers they correspond to. CodeWhisperer does not document
+// any, so only what a response actually carries is passed on.
+var upstreamLimits = []struct {
+	anthropic string
+	upstream  []string
+}{
+	{"anthropic-ratelimit-requests-limit", []string{"x-ratelimit-limit-requests", "x-ratelimit-limit"}},
+	{"anthropic-ratelimit-requests-remaining", []string{"x-ratelimit-remaining-requests", "x-ratelimit-remaining"}},
+	{"anthropic-ratelimit-requests-reset", []string{"x-ratelimit-reset-requests", "x-ratelimit-reset"}},
+	{"anthropic-ratelimit-tokens-limit", []string{"x-ratelimit-limit-tokens"}},
+	{"anthropic-ratelimit-tokens-remaining", []string{"x-ratelimit-remaining-tokens"}},
+	{"anthropic-ratelimit-tokens-reset", []string{"x-ratelimit-reset-tokens"}},
+}
+
+// setRateLimitHeaders copies the quota information in upstream's response
+// headers to h, in the form the Anthropic API uses. Headers already set
+// from the local rate limits are kept.
+func setRateLimitHeaders(h, upstream http.Header, now time.Time) {
+	for _, limit := range upstreamLimits {
+		if h.Get(limit.anthropic) != "" {
+			continue
+		}
+		for _, name := range limit.upstream {
+			value := strings.TrimSpace(upstream.Get(name))
+			if value == "" {
+				continue
+			}
+			if strings.HasSuffix(limit.anthropic, "-reset") {
+				reset, ok := parseReset(value, now)
+				if !ok {
+					break
+				}
+				value = reset.UTC().Format(time.RFC3339)
+			} else if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				break
+			}
+			h.Set(limit.anthropic, value)
+			break
+		}
+	}
+	if retryAfter := upstream.Get("Retry-After"); retryAfter != "" {
+		h.Set("retry-after", retryAfter)
+	}
+}
+
+// parseReset understands reset times given as seconds from now, a Unix
+// time, a duration such as "1m30s", or a timestamp.
+func parseReset(value string, now time.Time) (time.Time, bool) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		// Anything this large is a Unix time rather than a wait.
+		if seconds > 1e9 {
+			return time.Unix(int64(seconds), 0), true
+		}
+		return now.Add(time.Duration(seconds * float64(time.Second))), true
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// rateLimitMiddleware enforces the configured request and token limits,
+// answering 429 rate_limit_error like the Anthropic API when a bucket is
+// empty. The tokens a request used are charged once it completes.
+func (s *Server) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		keyID, keyName := "", ""
+		if key := apikeys.FromContext(ctx); key != nil {
+			keyID, keyName = key.ID, key.Name
+		}
+
+		d := s.limiter.Allow(keyID, keyName)
+		setLimitHeaders(w.Header(), "requests", d.Requests)
+		setLimitHeaders(w.Header(), "tokens", d.Tokens)
+		if !d.Allowed {
+			s.handlers.metrics.rateLimited.Inc(d.Scope, d.Kind)
+			s.logger.WarnContext(ctx, "Rate limit exceeded", "scope", d.Scope, "limit", d.Kind, "retry_after", d.RetryAfter.String())
+			w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(d.RetryAfter.Seconds()))))
+			scope := "the proxy's"
+			if d.Scope == ratelimit.ScopeKey {
+				scope = "this API key's"
+			}
+			writeAPIError(w, http.StatusTooManyRequests, errRateLimit,
+				fmt.Sprintf("This request would exceed %s %s rate limit, retry after %s", scope, d.Kind, d.RetryAfter.Round(time.Second)))
+			return
+		}
+
+		next(w, r)
+
+		info := requestInfoFrom(ctx)
+		s.limiter.Spend(keyID, keyName, info.inputTokens+info.outputTokens)
+	}
+}
+
+// setLimitHeaders reports a local limit in the anthropic-ratelimit-*
+// headers.
+func setLimitHeaders(h http.Header, kind string, state *ratelimit.State) {
+	if state == nil {
+		return
+	}
+	prefix := "anthropic-ratelimit-" + kind + "-"
+	h.Set(prefix+"limit", strconv.Itoa(state.Limit))
+	h.Set(prefix+"remaining", strconv.Itoa(state.Remaining))
+	h.Set(prefix+"reset", state.Reset.UTC().Format(time.RFC3339))
+}
@@ -1,57 +1,279 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/shyn/kiro2cc/internal/apikeys"
+	"github.com/shyn/kiro2cc/internal/client"
 	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/logging"
+	"github.com/shyn/kiro2cc/internal/ratelimit"
+	"github.com/shyn/kiro2cc/internal/tracing"
+	"github.com/shyn/kiro2cc/internal/usage"
 )
 
 type Server struct {
 	config   *config.Config
 	handlers *Handlers
-	logger   Logger
+	keys     *apikeys.Store
+	usage    *usage.Ledger
+	limiter  *ratelimit.Limiter
+	logger   *slog.Logger
+	active   atomic.Int64
+
+	startedAt time.Time
+	requests  atomic.Int64
+	inFlight  atomic.Int64
+	failed    atomic.Int64
 }
 
-func NewServer(cfg *config.Config, handlers *Handlers, logger Logger) *Server {
+func NewServer(cfg *config.Config, handlers *Handlers, keys *apikeys.Store, ledger *usage.Ledger, logger *slog.Logger) *Server {
 	return &Server{
 		config:   cfg,
 		handlers: handlers,
+		keys:     keys,
+		usage:    ledger,
+		limiter:  ratelimit.New(cfg.RateLimit),
 		logger:   logger,
 	}
 }
 
-func (s *Server) Start() error {
+// routes returns the server's endpoints with their middleware.
+func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/v1/messages", s.logMiddleware(s.handlers.MessagesHandler))
+	mux.HandleFunc("/v1/messages", s.logMiddleware(s.countMiddleware(s.traceMiddleware(s.authMiddleware(s.usageMiddleware(s.rateLimitMiddleware(s.handlers.MessagesHandler)))))))
 	mux.HandleFunc("/health", s.logMiddleware(s.handlers.HealthHandler))
+	mux.HandleFunc("/admin/status", s.logMiddleware(s.authMiddleware(s.statusHandler)))
+	mux.HandleFunc("/metrics", s.logMiddleware(s.authMiddleware(s.handlers.MetricsHandler)))
 	mux.HandleFunc("/", s.logMiddleware(s.handlers.NotFoundHandler))
+	return mux
+}
 
+func (s *Server) Start() error {
 	server := &http.Server{
-		Addr:         ":" + s.config.Server.Port,
-		Handler:      mux,
-		ReadTimeout:  s.config.Server.ReadTimeout,
-		WriteTimeout: s.config.Server.WriteTimeout,
+		Handler:           s.routes(),
+		ReadTimeout:       s.config.Server.ReadTimeout.Duration,
+		ReadHeaderTimeout: s.config.Server.ReadHeaderTimeout.Duration,
+		WriteTimeout:      s.config.Server.WriteTimeout.Duration,
+		IdleTimeout:       s.config.Server.IdleTimeout.Duration,
+	}
+
+	addresses := s.config.ListenAddresses()
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, addr := range addresses {
+		l, err := Listen(addr)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
 	}
 
-	s.logger.Info("Starting Anthropic API proxy server on port: %s", s.config.Server.Port)
-	s.logger.Info("Available endpoints:")
-	s.logger.Info("  POST /v1/messages - Anthropic API proxy")
-	s.logger.Info("  GET  /health      - Health check")
+	for _, addr := range addresses {
+		s.logger.Info("Starting Anthropic API proxy server", "address", addr)
+		if !isLoopback(addr) {
+			s.logger.Warn("Listen address is reachable from other machines", "address", addr)
+		}
+	}
+	s.logger.Info("Available endpoints",
+		"messages", "POST /v1/messages",
+		"health", "GET /health",
+		"status", "GET /admin/status",
+		"metrics", "GET /metrics")
+	if !s.config.Server.RequireAPIKey {
+		s.logger.Warn("API key authentication is disabled")
+	} else if ok, err := s.keys.HasKeys(); err == nil && !ok {
+		s.logger.Warn("No API keys exist yet, create one with 'kiro2cc keys create'")
+	}
 	s.logger.Info("Press Ctrl+C to stop server")
 
-	return server.ListenAndServe()
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	s.startedAt = time.Now()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+
+	select {
+	case err := <-errs:
+		// The first listener to fail takes the others down with it.
+		server.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	// Restore default signal handling so a second Ctrl+C exits at once.
+	stopSignals()
+	return s.shutdown(server)
+}
+
+// shutdown stops accepting connections and lets in-flight requests, such
+// as long streams, finish within the grace period before closing them.
+func (s *Server) shutdown(server *http.Server) error {
+	grace := s.config.Server.ShutdownGracePeriod.Duration
+	s.logger.Info("Shutting down, waiting for active requests", "grace_period", grace.String(), "active", s.active.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		s.logger.Error("Grace period expired, closing active requests", "active", s.active.Load())
+		server.Close()
+	}
+
+	s.logger.Info("Server stopped")
+	return nil
+}
+
+// Listen opens a listener for a "host:port" or "unix:///path" address.
+// Unix sockets are only accessible to the current user.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := config.UnixSocketPath(addr)
+	if !ok {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		return l, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	// A socket left behind by a crashed server would make Listen fail, but
+	// never remove one another server is still accepting on.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another server is already listening on %s", path)
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+func isLoopback(addr string) bool {
+	if _, ok := config.UnixSocketPath(addr); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func (s *Server) logMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
+		s.active.Add(1)
+		defer s.active.Add(-1)
+
+		// The ID is returned to the client, as Anthropic does, and sent
+		// upstream so that a report can be traced through both logs.
+		requestID := newID("req_")
+		w.Header().Set("request-id", requestID)
+		ctx := client.WithRequestID(logging.With(r.Context(), "request_id", requestID), requestID)
+		info := &requestInfo{}
+		ctx = withRequestInfo(ctx, info)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+
+		metrics := s.handlers.metrics
+		metrics.requests.Inc(r.Pattern, info.model, strconv.Itoa(rec.status))
+		metrics.requestDuration.Observe(time.Since(startTime).Seconds(), r.Pattern)
 
-		next(w, r)
+		s.logger.DebugContext(ctx, "Request processed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(startTime))
+	}
+}
+
+// traceMiddleware starts the server span of a request, continuing the
+// caller's trace when it sent a traceparent header.
+func (s *Server) traceMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := s.handlers.tracer.Start(ctx, r.Method+" "+r.Pattern, tracing.KindServer,
+			"http.request.method", r.Method,
+			"http.route", r.Pattern,
+			"kiro2cc.request_id", client.RequestIDFrom(ctx))
+		defer span.End()
+		if span.Sampled() {
+			ctx = logging.With(ctx, "trace_id", span.TraceID())
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
 
-		duration := time.Since(startTime)
-		s.logger.Debug("Request processed in: %v", duration)
+		span.SetAttributes("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.SetError(http.StatusText(rec.status))
+		}
 	}
 }
 
+// authMiddleware accepts the local API key in x-api-key, as the Anthropic
+// SDKs send it, or as a bearer token.
+func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.Server.RequireAPIKey {
+			next(w, r)
+			return
+		}
+
+		secret := r.Header.Get("x-api-key")
+		if secret == "" {
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				secret = strings.TrimSpace(bearer)
+			}
+		}
+		if secret == "" {
+			writeAPIError(w, http.StatusUnauthorized, errAuthentication, "x-api-key header is required")
+			return
+		}
+
+		key, err := s.keys.Authenticate(secret)
+		if err != nil {
+			if err != apikeys.ErrInvalidKey {
+				s.logger.ErrorContext(r.Context(), "Failed to check API key", "error", err)
+			}
+			writeAPIError(w, http.StatusUnauthorized, errAuthentication, "invalid x-api-key")
+			return
+		}
+
+		ctx := logging.With(apikeys.NewContext(r.Context(), key), "api_key", key.ID)
+		next(w, r.WithContext(ctx))
+	}
+}
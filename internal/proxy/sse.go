@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/metrics"
+	"github.com/shyn/kiro2cc/internal/traffic"
+)
+
+// sseStream writes server-sent events, pushing the connection's write
+// deadline forward before each event so that a long stream is limited by
+// its total duration rather than the server's WriteTimeout.
+type sseStream struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	deadline     time.Time
+	rec          *traffic.Recording
+	events       *metrics.Counter
+	// errType is the type of the last error event sent, if any.
+	errType string
+}
+
+func newSSEStream(w http.ResponseWriter, writeTimeout time.Duration, deadline time.Time, rec *traffic.Recording, events *metrics.Counter) *sseStream {
+	return &sseStream{
+		w:            w,
+		rc:           http.NewResponseController(w),
+		writeTimeout: writeTimeout,
+		deadline:     deadline,
+		rec:          rec,
+		events:       events,
+	}
+}
+
+// start sends the response headers.
+func (s *sseStream) start() error {
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.w.WriteHeader(http.StatusOK)
+	return s.flush()
+}
+
+func (s *sseStream) send(eventType string, data any) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.rec.ResponseEvent(eventType, jsonData)
+
+	if err := s.extendDeadline(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", eventType, jsonData); err != nil {
+		return err
+	}
+	s.events.Inc(eventType)
+	return s.flush()
+}
+
+func (s *sseStream) ping() error {
+	return s.send("ping", map[string]string{"type": "ping"})
+}
+
+func (s *sseStream) sendError(errType, message string) error {
+	s.errType = errType
+	return s.send("error", map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+func (s *sseStream) extendDeadline() error {
+	deadline := s.deadline
+	if s.writeTimeout > 0 {
+		if next := time.Now().Add(s.writeTimeout); next.Before(deadline) {
+			deadline = next
+		}
+	}
+	if err := s.rc.SetWriteDeadline(deadline); err != nil && err != http.ErrNotSupported {
+		return err
+	}
+	return nil
+}
+
+func (s *sseStream) flush() error {
+	if err := s.rc.Flush(); err != nil {
+		return fmt.Errorf("streaming unsupported: %w", err)
+	}
+	return nil
+}
+
+// pingTicker returns a channel that fires every interval, or never if
+// pings are disabled, and a function to stop it.
+func pingTicker(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/apikeys"
+	"github.com/shyn/kiro2cc/internal/client"
+	"github.com/shyn/kiro2cc/internal/usage"
+)
+
+// requestInfo carries what the handlers learn about a request back to the
+// middleware that counts it and records its usage.
+type requestInfo struct {
+	model        string
+	stream       bool
+	inputTokens  int
+	outputTokens int
+	// errType is the error sent in a stream whose status was already 200.
+	errType string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request's info, or a throwaway one for
+// requests that did not pass through logMiddleware.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// setRequestModel records the model of the request for its metrics.
+func setRequestModel(ctx context.Context, model string, stream bool) {
+	info := requestInfoFrom(ctx)
+	info.model, info.stream = model, stream
+}
+
+// setRequestUsage records the tokens reported to the client and, for a
+// stream, the type of the error it ended with, if any.
+func setRequestUsage(ctx context.Context, inputTokens, outputTokens int, errType string) {
+	info := requestInfoFrom(ctx)
+	info.inputTokens, info.outputTokens, info.errType = inputTokens, outputTokens, errType
+}
+
+// usageMiddleware appends each request to the usage ledger once it is
+// complete.
+func (s *Server) usageMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.usage == nil {
+			next(w, r)
+			return
+		}
+
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		ctx := r.Context()
+		info := requestInfoFrom(ctx)
+		record := usage.Record{
+			Time:         started,
+			RequestID:    client.RequestIDFrom(ctx),
+			Model:        info.model,
+			Stream:       info.stream,
+			Status:       rec.status,
+			Error:        info.errType,
+			InputTokens:  info.inputTokens,
+			OutputTokens: info.outputTokens,
+			LatencyMS:    time.Since(started).Milliseconds(),
+			Project:      projectFrom(r.Header),
+		}
+		if key := apikeys.FromContext(ctx); key != nil {
+			record.APIKey = key.ID
+		}
+		if err := s.usage.Append(record); err != nil {
+			s.logger.ErrorContext(ctx, "Failed to write usage ledger", "error", err)
+		}
+	}
+}
+
+// projectFrom decodes the project header, keeping it as sent if it is not
+// percent-encoded.
+func projectFrom(h http.Header) string {
+	value := h.Get(usage.ProjectHeader)
+	if decoded, err := url.PathUnescape(value); err == nil {
+		return decoded
+	}
+	return value
+}
@@ -0,0 +1,142 @@
+// Package queue limits how many upstream calls run at once, holding the
+// rest in a bounded priority queue.
+package queue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+var (
+	// ErrFull is returned when the queue already holds MaxQueued requests.
+	ErrFull = errors.New("too many requests are waiting for CodeWhisperer")
+	// ErrTimeout is returned when a request waited longer than Timeout.
+	ErrTimeout = errors.New("timed out waiting for a free CodeWhisperer slot")
+)
+
+// Queue hands out at most MaxInFlight slots. A nil *Queue never makes
+// anyone wait.
+type Queue struct {
+	maxInFlight int
+	maxQueued   int
+	timeout     time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	// waiting is ordered by priority, highest first, then by arrival.
+	waiting []*waiter
+	seq     uint64
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+// New returns a queue for cfg, or nil if cfg sets no limit.
+func New(cfg config.QueueConfig) *Queue {
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	return &Queue{
+		maxInFlight: cfg.MaxInFlight,
+		maxQueued:   cfg.MaxQueued,
+		timeout:     cfg.Timeout.Duration,
+	}
+}
+
+// Acquire waits until a slot is free and returns a function that gives it
+// back, which may be called more than once. It fails with ErrFull,
+// ErrTimeout or the context's error.
+func (q *Queue) Acquire(ctx context.Context, priority int) (release func(), err error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.inFlight < q.maxInFlight && len(q.waiting) == 0 {
+		q.inFlight++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	if len(q.waiting) >= q.maxQueued {
+		q.mu.Unlock()
+		return nil, ErrFull
+	}
+	q.seq++
+	w := &waiter{priority: priority, seq: q.seq, ready: make(chan struct{})}
+	i := sort.Search(len(q.waiting), func(i int) bool {
+		return q.waiting[i].priority < priority
+	})
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = w
+	q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if q.timeout > 0 {
+		t := time.NewTimer(q.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-w.ready:
+		return q.releaser(), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrTimeout
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return nil, err
+		}
+	}
+	// The slot was handed over just as the wait ended; pass it on.
+	q.next()
+	return nil, err
+}
+
+// releaser returns the function that frees a slot once.
+func (q *Queue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.next()
+		})
+	}
+}
+
+// next gives a freed slot to the first waiter, if any. q.mu must be held.
+func (q *Queue) next() {
+	if len(q.waiting) == 0 {
+		q.inFlight--
+		return
+	}
+	w := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(w.ready)
+}
+
+// Stats returns the number of slots in use and of requests waiting.
+func (q *Queue) Stats() (inFlight, waiting int) {
+	if q == nil {
+		return 0, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inFlight, len(q.waiting)
+}
@@ -0,0 +1,127 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+func newTestQueue(maxInFlight, maxQueued int, timeout time.Duration) *Queue {
+	return New(config.QueueConfig{
+		MaxInFlight: maxInFlight,
+		MaxQueued:   maxQueued,
+		Timeout:     config.Duration{Duration: timeout},
+	})
+}
+
+// waitForWaiting blocks until n requests are queued.
+func waitForWaiting(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, waiting := q.Stats(); waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("queue never held %d waiting requests", n)
+}
+
+func TestPriorityThenFIFO(t *testing.T) {
+	q := newTestQueue(1, 10, 0)
+	release, err := q.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 4)
+	enqueue := func(name string, priority, waiting int) {
+		go func() {
+			r, err := q.Acquire(context.Background(), priority)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- name
+			r()
+		}()
+		waitForWaiting(t, q, waiting)
+	}
+	enqueue("low-1", 0, 1)
+	enqueue("low-2", 0, 2)
+	enqueue("high", 5, 3)
+	enqueue("mid", 1, 4)
+
+	release()
+	release() // a second call must not free another slot
+	for _, want := range []string{"high", "mid", "low-1", "low-2"} {
+		if got := <-order; got != want {
+			t.Fatalf("served %s, want %s", got, want)
+		}
+	}
+	if inFlight, waiting := q.Stats(); inFlight != 0 || waiting != 0 {
+		t.Fatalf("Stats() = %d, %d after all released", inFlight, waiting)
+	}
+}
+
+func TestFullAndTimeout(t *testing.T) {
+	q := newTestQueue(1, 1, 20*time.Millisecond)
+	release, _ := q.Acquire(context.Background(), 0)
+	defer release()
+
+	errs := make(chan error)
+	go func() {
+		_, err := q.Acquire(context.Background(), 0)
+		errs <- err
+	}()
+	waitForWaiting(t, q, 1)
+
+	if _, err := q.Acquire(context.Background(), 0); err != ErrFull {
+		t.Fatalf("Acquire on a full queue = %v, want ErrFull", err)
+	}
+	if err := <-errs; err != ErrTimeout {
+		t.Fatalf("queued Acquire = %v, want ErrTimeout", err)
+	}
+	if _, waiting := q.Stats(); waiting != 0 {
+		t.Fatalf("%d still waiting after the timeout", waiting)
+	}
+}
+
+func TestCancelledWaiterLeavesQueue(t *testing.T) {
+	q := newTestQueue(1, 10, 0)
+	release, _ := q.Acquire(context.Background(), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := q.Acquire(ctx, 0)
+		errs <- err
+	}()
+	waitForWaiting(t, q, 1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("cancelled Acquire = %v", err)
+	}
+
+	release()
+	if inFlight, _ := q.Stats(); inFlight != 0 {
+		t.Fatalf("%d in flight after release, the slot went to a cancelled waiter", inFlight)
+	}
+	if _, err := q.Acquire(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNilQueue(t *testing.T) {
+	if q := New(config.QueueConfig{}); q != nil {
+		t.Fatal("New() without maxInFlight returned a queue")
+	}
+	var q *Queue
+	release, err := q.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
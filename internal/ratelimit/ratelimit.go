@@ -0,0 +1,223 @@
+// Package ratelimit enforces token-bucket limits on requests and tokens,
+// globally and per local API key.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// Scopes and kinds of limit reported in a Decision.
+const (
+	ScopeGlobal = "global"
+	ScopeKey    = "key"
+
+	KindRequests = "requests"
+	KindTokens   = "tokens"
+)
+
+// State describes one bucket for the anthropic-ratelimit-* headers.
+type State struct {
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again.
+	Reset time.Time
+}
+
+// Decision is the outcome of Allow.
+type Decision struct {
+	Allowed bool
+	// RetryAfter, Scope and Kind say which limit rejected the request and
+	// when it will admit one again.
+	RetryAfter time.Duration
+	Scope      string
+	Kind       string
+	// Requests and Tokens are the tightest applicable buckets, or nil when
+	// there is no such limit.
+	Requests *State
+	Tokens   *State
+}
+
+// Limiter tracks the buckets of every key. A nil *Limiter allows
+// everything.
+type Limiter struct {
+	cfg config.RateLimitConfig
+	now func() time.Time
+
+	mu     sync.Mutex
+	global *limits
+	keys   map[string]*limits
+}
+
+// limits holds the buckets of one scope; either may be nil if unlimited.
+type limits struct {
+	scope    string
+	requests *bucket
+	tokens   *bucket
+}
+
+// New returns a limiter for cfg, or nil if cfg sets no limits.
+func New(cfg config.RateLimitConfig) *Limiter {
+	if !cfg.Global.Enabled() && !cfg.PerKey.Enabled() && len(cfg.Keys) == 0 {
+		return nil
+	}
+	return newLimiter(cfg, time.Now)
+}
+
+func newLimiter(cfg config.RateLimitConfig, now func() time.Time) *Limiter {
+	return &Limiter{
+		cfg:    cfg,
+		now:    now,
+		global: newLimits(ScopeGlobal, cfg.Global, now()),
+		keys:   make(map[string]*limits),
+	}
+}
+
+func newLimits(scope string, cfg config.Limits, now time.Time) *limits {
+	l := &limits{scope: scope}
+	if cfg.RequestsPerMinute > 0 {
+		l.requests = newBucket(cfg.RequestsPerMinute, time.Minute, now)
+	}
+	if cfg.TokensPerDay > 0 {
+		l.tokens = newBucket(cfg.TokensPerDay, 24*time.Hour, now)
+	}
+	return l
+}
+
+// Allow takes one request from the global bucket and the bucket of the
+// key with the given ID and name, if any, or reports which one is empty.
+// Requests without a key only count against the global limits.
+func (l *Limiter) Allow(keyID, keyName string) Decision {
+	if l == nil {
+		return Decision{Allowed: true}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	scopes := l.scopes(keyID, keyName, now)
+	d := Decision{Allowed: true}
+	for _, s := range scopes {
+		for _, check := range []struct {
+			kind string
+			b    *bucket
+		}{{KindRequests, s.requests}, {KindTokens, s.tokens}} {
+			if check.b == nil {
+				continue
+			}
+			check.b.refill(now)
+			if wait := check.b.wait(1); wait > 0 && wait > d.RetryAfter {
+				d = Decision{RetryAfter: wait, Scope: s.scope, Kind: check.kind}
+			}
+		}
+	}
+	if d.RetryAfter == 0 {
+		for _, s := range scopes {
+			if s.requests != nil {
+				s.requests.level--
+			}
+		}
+	}
+
+	for _, s := range scopes {
+		d.Requests = tightest(d.Requests, s.requests, now)
+		d.Tokens = tightest(d.Tokens, s.tokens, now)
+	}
+	return d
+}
+
+// Spend charges the tokens a completed request used to its buckets. A
+// bucket may go below zero, which holds back the next request until it
+// has refilled.
+func (l *Limiter) Spend(keyID, keyName string, tokens int) {
+	if l == nil || tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for _, s := range l.scopes(keyID, keyName, now) {
+		if s.tokens != nil {
+			s.tokens.refill(now)
+			s.tokens.level -= float64(tokens)
+		}
+	}
+}
+
+// scopes returns the global limits and those of the key, if it has any.
+func (l *Limiter) scopes(keyID, keyName string, now time.Time) []*limits {
+	scopes := []*limits{l.global}
+	if keyID == "" {
+		return scopes
+	}
+	keyLimits, ok := l.keys[keyID]
+	if !ok {
+		cfg, ok := l.cfg.Keys[keyID]
+		if !ok {
+			cfg, ok = l.cfg.Keys[keyName]
+		}
+		if !ok {
+			cfg = l.cfg.PerKey
+		}
+		keyLimits = newLimits(ScopeKey, cfg, now)
+		l.keys[keyID] = keyLimits
+	}
+	return append(scopes, keyLimits)
+}
+
+// tightest returns whichever of current and b has less remaining.
+func tightest(current *State, b *bucket, now time.Time) *State {
+	if b == nil {
+		return current
+	}
+	s := b.state(now)
+	if current == nil || s.Remaining < current.Remaining {
+		return &s
+	}
+	return current
+}
+
+// bucket holds up to capacity and refills at rate per second.
+type bucket struct {
+	capacity float64
+	rate     float64
+	level    float64
+	last     time.Time
+}
+
+func newBucket(perPeriod int, period time.Duration, now time.Time) *bucket {
+	return &bucket{
+		capacity: float64(perPeriod),
+		rate:     float64(perPeriod) / period.Seconds(),
+		level:    float64(perPeriod),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until the bucket holds n.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration(math.Ceil((n - b.level) / b.rate * float64(time.Second)))
+}
+
+func (b *bucket) state(now time.Time) State {
+	full := time.Duration((b.capacity - b.level) / b.rate * float64(time.Second))
+	return State{
+		Limit:     int(b.capacity),
+		Remaining: max(0, int(math.Floor(b.level))),
+		Reset:     now.Add(full),
+	}
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestLimiter(cfg config.RateLimitConfig) (*Limiter, *clock) {
+	c := &clock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return newLimiter(cfg, c.now), c
+}
+
+func TestRequestsPerMinutePerKey(t *testing.T) {
+	l, c := newTestLimiter(config.RateLimitConfig{PerKey: config.Limits{RequestsPerMinute: 2}})
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow("k1", "work"); !d.Allowed {
+			t.Fatalf("request %d rejected: %+v", i+1, d)
+		}
+	}
+	d := l.Allow("k1", "work")
+	if d.Allowed || d.Scope != ScopeKey || d.Kind != KindRequests {
+		t.Fatalf("third request = %+v, want rejected by the key's request limit", d)
+	}
+	if d.RetryAfter != 30*time.Second {
+		t.Fatalf("RetryAfter = %v, want 30s for one request at 2/min", d.RetryAfter)
+	}
+
+	// Other keys have their own bucket.
+	if d := l.Allow("k2", "home"); !d.Allowed {
+		t.Fatalf("another key was rejected: %+v", d)
+	}
+
+	c.t = c.t.Add(30 * time.Second)
+	d = l.Allow("k1", "work")
+	if !d.Allowed {
+		t.Fatalf("request after refill rejected: %+v", d)
+	}
+	if d.Requests == nil || d.Requests.Limit != 2 || d.Requests.Remaining != 0 {
+		t.Fatalf("Requests state = %+v, want limit 2, remaining 0", d.Requests)
+	}
+}
+
+func TestGlobalLimitCoversRequestsWithoutKey(t *testing.T) {
+	l, _ := newTestLimiter(config.RateLimitConfig{Global: config.Limits{RequestsPerMinute: 1}})
+
+	if d := l.Allow("", ""); !d.Allowed {
+		t.Fatalf("first request rejected: %+v", d)
+	}
+	if d := l.Allow("k1", "work"); d.Allowed || d.Scope != ScopeGlobal {
+		t.Fatalf("second request = %+v, want rejected by the global limit", d)
+	}
+}
+
+func TestTokensPerDay(t *testing.T) {
+	l, c := newTestLimiter(config.RateLimitConfig{
+		PerKey: config.Limits{TokensPerDay: 1000},
+		Keys:   map[string]config.Limits{"big": {TokensPerDay: 100000}},
+	})
+
+	if d := l.Allow("k1", "work"); !d.Allowed {
+		t.Fatalf("first request rejected: %+v", d)
+	}
+	// A request may overrun the budget; the next one then waits.
+	l.Spend("k1", "work", 1500)
+	d := l.Allow("k1", "work")
+	if d.Allowed || d.Kind != KindTokens {
+		t.Fatalf("request over budget = %+v, want rejected by the token limit", d)
+	}
+	// 501 tokens at 1000/day take a little over 12 hours to refill.
+	if d.RetryAfter < 12*time.Hour || d.RetryAfter > 12*time.Hour+2*time.Minute {
+		t.Fatalf("RetryAfter = %v, want about 12h", d.RetryAfter)
+	}
+
+	c.t = c.t.Add(d.RetryAfter)
+	if d := l.Allow("k1", "work"); !d.Allowed {
+		t.Fatalf("request after refill rejected: %+v", d)
+	}
+
+	// Keys named in the config get their own limits.
+	l.Allow("k9", "big")
+	l.Spend("k9", "big", 1500)
+	if d := l.Allow("k9", "big"); !d.Allowed || d.Tokens.Limit != 100000 {
+		t.Fatalf("key with a larger budget = %+v", d)
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	if l := New(config.RateLimitConfig{}); l != nil {
+		t.Fatal("New() without limits returned a limiter")
+	}
+	var l *Limiter
+	if d := l.Allow("k1", "work"); !d.Allowed {
+		t.Fatal("nil limiter rejected a request")
+	}
+	l.Spend("k1", "work", 10)
+}
@@ -0,0 +1,106 @@
+// Package stopseq finds stop sequences in generated text, including in a
+// stream where a sequence may be split across deltas.
+package stopseq
+
+import "strings"
+
+// Cut returns the text before the earliest stop sequence in text and the
+// sequence that matched, or text unchanged and found false.
+func Cut(text string, seqs []string) (before, seq string, found bool) {
+	at := -1
+	for _, s := range seqs {
+		i := strings.Index(text, s)
+		if i < 0 {
+			continue
+		}
+		// Of two sequences starting at the same place, the shorter one
+		// would have been complete first.
+		if at < 0 || i < at || (i == at && len(s) < len(seq)) {
+			at, seq = i, s
+		}
+	}
+	if at < 0 {
+		return text, "", false
+	}
+	return text[:at], seq, true
+}
+
+// Scanner watches a stream of text deltas for stop sequences. It holds
+// back the end of the text while it could still be the start of one, so
+// that nothing past a stop sequence is ever released. A nil *Scanner
+// passes everything through.
+type Scanner struct {
+	seqs    []string
+	held    string
+	matched string
+}
+
+// NewScanner returns a scanner for seqs, or nil if there are none.
+func NewScanner(seqs []string) *Scanner {
+	var nonEmpty []string
+	for _, s := range seqs {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil
+	}
+	return &Scanner{seqs: nonEmpty}
+}
+
+// Feed takes the next delta and returns the text that may be sent now.
+// Once a stop sequence has matched, stopped is true and the text up to it
+// has been returned; later calls return nothing.
+func (s *Scanner) Feed(text string) (emit string, stopped bool) {
+	if s == nil {
+		return text, false
+	}
+	if s.matched != "" {
+		return "", true
+	}
+
+	buf := s.held + text
+	if before, seq, found := Cut(buf, s.seqs); found {
+		s.held, s.matched = "", seq
+		return before, true
+	}
+	keep := s.partialMatch(buf)
+	s.held = buf[len(buf)-keep:]
+	return buf[:len(buf)-keep], false
+}
+
+// Flush returns the text still held back, for when the text ends without
+// a stop sequence.
+func (s *Scanner) Flush() string {
+	if s == nil {
+		return ""
+	}
+	held := s.held
+	s.held = ""
+	return held
+}
+
+// Matched returns the stop sequence that was found, if any.
+func (s *Scanner) Matched() string {
+	if s == nil {
+		return ""
+	}
+	return s.matched
+}
+
+// partialMatch returns the length of the longest end of buf that is the
+// start of a stop sequence. That end begins where a sequence does, so it
+// never splits a UTF-8 character.
+func (s *Scanner) partialMatch(buf string) int {
+	longest := 0
+	for _, seq := range s.seqs {
+		for n := min(len(seq)-1, len(buf)); n > longest; n-- {
+			if strings.HasSuffix(buf, seq[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
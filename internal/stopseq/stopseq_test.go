@@ -0,0 +1,82 @@
+package stopseq
+
+import (
+	"strings"
+	"testing"
+)
+
+// feed sends the deltas through a scanner and returns what it released
+// and the sequence it stopped at.
+func feed(s *Scanner, deltas ...string) (string, string) {
+	var out strings.Builder
+	for _, d := range deltas {
+		emit, stopped := s.Feed(d)
+		out.WriteString(emit)
+		if stopped {
+			return out.String(), s.Matched()
+		}
+	}
+	out.WriteString(s.Flush())
+	return out.String(), s.Matched()
+}
+
+func TestScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		seqs    []string
+		deltas  []string
+		want    string
+		matched string
+	}{
+		{"no match", []string{"STOP"}, []string{"hello ", "world"}, "hello world", ""},
+		{"within a delta", []string{"STOP"}, []string{"one STOP two"}, "one ", "STOP"},
+		{"split across deltas", []string{"STOP"}, []string{"one ST", "O", "P two"}, "one ", "STOP"},
+		{"false start", []string{"STOP"}, []string{"one ST", "ART two"}, "one START two", ""},
+		{"partial at the end", []string{"STOP"}, []string{"one STO"}, "one STO", ""},
+		{"earliest wins", []string{"bb", "a"}, []string{"xxbb", "a"}, "xx", "bb"},
+		{"shorter wins at the same place", []string{"abc", "ab"}, []string{"xab", "c"}, "x", "ab"},
+		{"multibyte", []string{"。\n"}, []string{"你好。", "\n再见"}, "你好", "。\n"},
+		{"overlapping prefix", []string{"aab"}, []string{"a", "a", "a", "b"}, "a", "aab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, matched := feed(NewScanner(tt.seqs), tt.deltas...)
+			if got != tt.want || matched != tt.matched {
+				t.Fatalf("got %q stopping at %q, want %q stopping at %q", got, matched, tt.want, tt.matched)
+			}
+		})
+	}
+}
+
+func TestScannerHoldsBackOnlyPossibleMatches(t *testing.T) {
+	s := NewScanner([]string{"</answer>"})
+	if emit, _ := s.Feed("done</ans"); emit != "done" {
+		t.Fatalf("Feed released %q, want %q", emit, "done")
+	}
+	if emit, _ := s.Feed("wer> trailing"); emit != "" {
+		t.Fatalf("Feed after the match released %q", emit)
+	}
+	if emit, stopped := s.Feed("more"); emit != "" || !stopped {
+		t.Fatalf("Feed after stopping = %q, %v", emit, stopped)
+	}
+}
+
+func TestNilScanner(t *testing.T) {
+	s := NewScanner([]string{""})
+	if s != nil {
+		t.Fatal("NewScanner with only empty sequences returned a scanner")
+	}
+	if emit, stopped := s.Feed("text"); emit != "text" || stopped {
+		t.Fatalf("nil Feed = %q, %v", emit, stopped)
+	}
+}
+
+func TestCut(t *testing.T) {
+	before, seq, found := Cut("a\n\nHuman: b", []string{"\n\nHuman:"})
+	if !found || before != "a" || seq != "\n\nHuman:" {
+		t.Fatalf("Cut = %q, %q, %v", before, seq, found)
+	}
+	if before, _, found := Cut("abc", []string{"x"}); found || before != "abc" {
+		t.Fatalf("Cut without a match = %q, %v", before, found)
+	}
+}
@@ -0,0 +1,71 @@
+// Package tokens estimates token counts, since CodeWhisperer does not
+// report usage.
+package tokens
+
+import (
+	"math"
+	"unicode/utf8"
+)
+
+// weight is the estimated share of a token one character takes: English
+// text averages about four characters per token, while most other scripts
+// take a token or more per character.
+func weight(r rune) float64 {
+	if r < utf8.RuneSelf {
+		return 0.25
+	}
+	return 1
+}
+
+// Estimate returns the estimated number of tokens in text.
+func Estimate(text string) int {
+	var used float64
+	for _, r := range text {
+		used += weight(r)
+	}
+	return int(math.Ceil(used))
+}
+
+// Counter counts output against a budget of tokens.
+type Counter struct {
+	budget int
+	used   float64
+}
+
+// NewCounter returns a counter for budget tokens, or an unlimited one if
+// budget is zero.
+func NewCounter(budget int) *Counter {
+	return &Counter{budget: budget}
+}
+
+// Take counts text and returns as much of it as fits in the budget. full
+// is true if some of the text did not fit.
+func (c *Counter) Take(text string) (fits string, full bool) {
+	for i, r := range text {
+		w := weight(r)
+		if c.budget > 0 && c.used+w > float64(c.budget) {
+			return text[:i], true
+		}
+		c.used += w
+	}
+	return text, false
+}
+
+// TakeAll counts text only if all of it fits, for output that cannot be
+// cut short such as a tool call's input.
+func (c *Counter) TakeAll(text string) bool {
+	var w float64
+	for _, r := range text {
+		w += weight(r)
+	}
+	if c.budget > 0 && c.used+w > float64(c.budget) {
+		return false
+	}
+	c.used += w
+	return true
+}
+
+// Count returns the tokens counted so far.
+func (c *Counter) Count() int {
+	return int(math.Ceil(c.used))
+}
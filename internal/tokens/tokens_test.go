@@ -0,0 +1,60 @@
+package tokens
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	for text, want := range map[string]int{
+		"":         0,
+		"abcd":     1,
+		"abcde":    2,
+		"你好":       2,
+		"hello 世界": 4,
+	} {
+		if got := Estimate(text); got != want {
+			t.Errorf("Estimate(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestCounterTake(t *testing.T) {
+	c := NewCounter(3)
+	if fits, full := c.Take("abcdefgh"); fits != "abcdefgh" || full {
+		t.Fatalf("Take within budget = %q, %v", fits, full)
+	}
+	if fits, full := c.Take("ijkl你好"); fits != "ijkl" || !full {
+		t.Fatalf("Take over budget = %q, %v, want %q cut before the CJK text", fits, full, "ijkl")
+	}
+	if c.Count() != 3 {
+		t.Fatalf("Count() = %d, want 3", c.Count())
+	}
+	if fits, full := c.Take("m"); fits != "" || !full {
+		t.Fatalf("Take on a spent budget = %q, %v", fits, full)
+	}
+}
+
+func TestCounterTakeAll(t *testing.T) {
+	c := NewCounter(2)
+	if !c.TakeAll("abcd") {
+		t.Fatal("TakeAll rejected input within budget")
+	}
+	if c.TakeAll(`{"path":"x"}`) {
+		t.Fatal("TakeAll accepted input over budget")
+	}
+	if c.Count() != 1 {
+		t.Fatalf("Count() = %d, rejected input was counted", c.Count())
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	c := NewCounter(0)
+	text := strings.Repeat("word ", 1000)
+	if fits, full := c.Take(text); fits != text || full {
+		t.Fatal("unlimited counter cut the text")
+	}
+	if c.Count() != 1250 {
+		t.Fatalf("Count() = %d, want 1250", c.Count())
+	}
+}
@@ -0,0 +1,291 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/internal/version"
+)
+
+const (
+	// exportInterval is how often queued spans are sent.
+	exportInterval = 5 * time.Second
+	// batchSize sends a batch early once this many spans are queued.
+	batchSize = 256
+	// maxQueue drops new spans rather than grow without bound while the
+	// collector is unreachable.
+	maxQueue = 4096
+)
+
+// exporter sends ended spans to the collector from a background
+// goroutine.
+type exporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	logger      *slog.Logger
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newExporter(cfg config.TracingConfig, logger *slog.Logger) *exporter {
+	e := &exporter{
+		endpoint:    cfg.Endpoint,
+		headers:     cfg.Headers,
+		serviceName: cfg.ServiceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) enqueue(span *Span) {
+	e.mu.Lock()
+	if len(e.queue) >= maxQueue {
+		e.dropped++
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, span)
+	full := len(e.queue) >= batchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.wake:
+		case <-e.stop:
+			return
+		}
+		e.flush(context.Background())
+	}
+}
+
+// shutdown stops the background goroutine and sends what is left.
+func (e *exporter) shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.stop) })
+	select {
+	case <-e.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.flush(ctx)
+}
+
+func (e *exporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	batch, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.logger.Warn("Trace export queue is full, dropped spans", "dropped", dropped)
+	}
+	for len(batch) > 0 {
+		n := min(len(batch), batchSize)
+		if err := e.export(ctx, batch[:n]); err != nil {
+			e.logger.Warn("Failed to export traces", "endpoint", e.endpoint, "spans", len(batch), "error", err)
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+func (e *exporter) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The types below are the parts of the OTLP/JSON trace request kiro2cc
+// uses, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+// IDs are hex strings and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	// Code is 0 for unset and 2 for error.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *exporter) request(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	resource := []attribute{{"service.name", e.serviceName}, {"service.version", version.Version}}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(resource)},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/shyn/kiro2cc", Version: version.Version},
+			Spans: out,
+		}},
+	}}}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, ev := range s.events {
+		span.Events = append(span.Events, otlpEvent{
+			TimeUnixNano: unixNano(ev.time),
+			Name:         ev.name,
+			Attributes:   otlpAttributes(ev.attrs),
+		})
+	}
+	if s.failed {
+		span.Status = otlpStatus{Code: 2, Message: s.message}
+	}
+	return span
+}
+
+func otlpAttributes(attrs []attribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch value := a.value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: a.key, Value: v})
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,283 @@
+// Package tracing records OpenTelemetry spans for the proxy and exports
+// them to a collector over OTLP/HTTP with JSON encoding.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so callers do
+// not need to check whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Tracer starts spans and exports the sampled ones in batches.
+type Tracer struct {
+	cfg      config.TracingConfig
+	exporter *exporter
+	sample   func() float64
+}
+
+// NewTracer returns a tracer exporting to cfg.Endpoint, or nil when
+// tracing is disabled.
+func NewTracer(cfg config.TracingConfig, logger *slog.Logger) *Tracer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Tracer{
+		cfg:      cfg,
+		exporter: newExporter(cfg, logger),
+		sample:   mathrand.Float64,
+	}
+}
+
+// Shutdown exports the spans that are still queued and stops the
+// background exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
+
+// Span is one timed operation within a trace.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	// remote marks the caller's span taken from a traceparent header,
+	// which only parents local spans and is never exported.
+	remote bool
+
+	name  string
+	kind  Kind
+	start time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []attribute
+	events  []event
+	failed  bool
+	message string
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+type event struct {
+	name  string
+	time  time.Time
+	attrs []attribute
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the current span of ctx, or nil.
+func SpanFrom(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span as a child of the current span of ctx, or of a
+// new trace when there is none. attrs are alternating keys and values.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attrs ...any) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := SpanFrom(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = t.sample() < t.cfg.SampleRatio
+	}
+	rand.Read(span.spanID[:])
+	span.attrs = appendAttributes(nil, attrs)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// TraceID returns the trace ID in hex, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Sampled reports whether the span will be exported.
+func (s *Span) Sampled() bool {
+	return s != nil && s.sampled
+}
+
+// SetAttributes adds alternating keys and values to the span.
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = appendAttributes(s.attrs, attrs)
+}
+
+// AddEvent marks a moment within the span, such as the first frame.
+func (s *Span) AddEvent(name string, attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event{name: name, time: time.Now(), attrs: appendAttributes(nil, attrs)})
+}
+
+// RecordError marks the span as failed. A nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.message = err.Error()
+	s.events = append(s.events, event{
+		name:  "exception",
+		time:  time.Now(),
+		attrs: []attribute{{"exception.message", err.Error()}},
+	})
+}
+
+// SetError marks the span as failed with a message, for failures that
+// are not Go errors, such as an error status from upstream.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.message = message
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil || s.remote {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled {
+		s.tracer.exporter.enqueue(s)
+	}
+}
+
+func appendAttributes(attrs []attribute, kv []any) []attribute {
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		attrs = append(attrs, attribute{key, kv[i+1]})
+	}
+	return attrs
+}
+
+// Extract returns ctx with the caller's span from a W3C traceparent
+// header as the parent of the spans started from it. Malformed headers
+// are ignored and a new trace is started instead.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	span, ok := parseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Inject sets the traceparent header for the current span of ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if span := SpanFrom(ctx); span != nil {
+		h.Set("traceparent", span.traceparent())
+	}
+}
+
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags)
+}
+
+// parseTraceparent parses "version-traceid-parentid-flags", see
+// https://www.w3.org/TR/trace-context/#traceparent-header.
+func parseTraceparent(value string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return nil, false
+	}
+	// Version 00 has exactly four fields; later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil, false
+	}
+
+	span := &Span{remote: true}
+	if !decodeID(span.traceID[:], parts[1]) || !decodeID(span.spanID[:], parts[2]) {
+		return nil, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return nil, false
+	}
+	span.sampled = flags[0]&1 == 1
+	return span, true
+}
+
+// decodeID decodes a lowercase hex ID, which must not be all zeros.
+func decodeID(dst []byte, s string) bool {
+	if !decodeHex(dst, s) {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
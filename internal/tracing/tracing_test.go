@@ -0,0 +1,195 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// collector stands in for an OTLP/HTTP collector and keeps the spans it
+// receives.
+type collector struct {
+	mu      sync.Mutex
+	spans   []otlpSpan
+	headers http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req otlpRequest
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = r.Header
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Write([]byte("{}"))
+}
+
+func newTestTracer(t *testing.T, c *collector, ratio float64) *Tracer {
+	t.Helper()
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return NewTracer(config.TracingConfig{
+		Enabled:     true,
+		Endpoint:    srv.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer test"},
+		ServiceName: "kiro2cc-test",
+		SampleRatio: ratio,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func attr(span otlpSpan, key string) *otlpValue {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			return &a.Value
+		}
+	}
+	return nil
+}
+
+func TestSpansAreExportedWithIncomingParent(t *testing.T) {
+	c := &collector{}
+	tracer := newTestTracer(t, c, 1)
+
+	h := http.Header{}
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), h)
+
+	ctx, root := tracer.Start(ctx, "POST /v1/messages", KindServer, "http.route", "/v1/messages")
+	_, child := tracer.Start(ctx, "translate", KindInternal)
+	child.AddEvent("first_frame", "frames", 1)
+	child.RecordError(errors.New("boom"))
+	child.End()
+	root.SetAttributes("http.response.status_code", 200)
+	root.End()
+	root.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if got := c.headers.Get("Authorization"); got != "Bearer test" {
+		t.Errorf("Authorization header = %q, want configured header", got)
+	}
+	if len(c.spans) != 2 {
+		t.Fatalf("collector received %d spans, want 2", len(c.spans))
+	}
+	translate, server := c.spans[0], c.spans[1]
+
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("server span trace %s parent %s, want the traceparent's", server.TraceID, server.ParentSpanID)
+	}
+	if server.Kind != KindServer {
+		t.Errorf("server span kind = %d, want %d", server.Kind, KindServer)
+	}
+	if v := attr(server, "http.response.status_code"); v == nil || v.IntValue == nil || *v.IntValue != "200" {
+		t.Errorf("status code attribute = %+v, want intValue 200", v)
+	}
+	if translate.TraceID != server.TraceID || translate.ParentSpanID != server.SpanID {
+		t.Errorf("translate span is not a child of the server span")
+	}
+	if translate.Status.Code != 2 || translate.Status.Message != "boom" {
+		t.Errorf("translate status = %+v, want error boom", translate.Status)
+	}
+	if len(translate.Events) != 2 || translate.Events[0].Name != "first_frame" || translate.Events[1].Name != "exception" {
+		t.Errorf("translate events = %+v, want first_frame and exception", translate.Events)
+	}
+}
+
+func TestUnsampledTracesAreNotExported(t *testing.T) {
+	c := &collector{}
+	tracer := newTestTracer(t, c, 1)
+
+	h := http.Header{}
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span := tracer.Start(Extract(context.Background(), h), "POST /v1/messages", KindServer)
+	span.End()
+
+	none := newTestTracer(t, c, 0)
+	_, span = none.Start(context.Background(), "POST /v1/messages", KindServer)
+	span.End()
+
+	tracer.Shutdown(context.Background())
+	none.Shutdown(context.Background())
+	if len(c.spans) != 0 {
+		t.Fatalf("collector received %d unsampled spans", len(c.spans))
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"garbage", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		span, ok := parseTraceparent(tt.value)
+		if ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			continue
+		}
+		if ok && span.sampled != tt.sampled {
+			t.Errorf("parseTraceparent(%q) sampled = %v, want %v", tt.value, span.sampled, tt.sampled)
+		}
+	}
+}
+
+func TestInjectRoundTrips(t *testing.T) {
+	tracer := newTestTracer(t, &collector{}, 1)
+	defer tracer.Shutdown(context.Background())
+
+	ctx, span := tracer.Start(context.Background(), "upstream", KindClient)
+	h := http.Header{}
+	Inject(ctx, h)
+
+	parsed, ok := parseTraceparent(h.Get("traceparent"))
+	if !ok || parsed.traceID != span.traceID || parsed.spanID != span.spanID || !parsed.sampled {
+		t.Fatalf("Inject() wrote %q, which does not identify the span", h.Get("traceparent"))
+	}
+}
+
+func TestNilTracerIsSafe(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "noop", KindInternal)
+	span.SetAttributes("k", "v")
+	span.AddEvent("e")
+	span.RecordError(errors.New("x"))
+	span.End()
+	if SpanFrom(ctx) != nil || span.TraceID() != "" {
+		t.Fatal("nil tracer started a span")
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,234 @@
+// Package traffic records request and response bodies per request, for
+// debugging translation problems. It is off unless enabled in the config.
+package traffic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// Kinds of recorded entries, in the order a request produces them.
+const (
+	KindRequest         = "request"
+	KindUpstreamRequest = "upstream_request"
+	KindUpstreamFrame   = "upstream_frame"
+	KindResponse        = "response"
+	KindResponseEvent   = "response_event"
+)
+
+// pruneInterval limits how often the traffic directory is scanned for
+// files beyond the size cap.
+const pruneInterval = time.Minute
+
+// Entry is one line of a traffic file.
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"request_id"`
+	Kind      string            `json:"kind"`
+	Event     string            `json:"event,omitempty"`
+	Account   string            `json:"account,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// Body is embedded as JSON when it still is JSON after redaction and
+	// truncation, and as a string otherwise.
+	Body      any  `json:"body,omitempty"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Recorder creates a Recording per request.
+type Recorder struct {
+	dir          string
+	maxBodyBytes int
+	maxTotal     int64
+	redactor     *Redactor
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// NewRecorder returns nil when traffic logging is disabled. A nil
+// Recorder hands out nil Recordings, which record nothing.
+func NewRecorder(cfg config.TrafficConfig) (*Recorder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	redactor, err := NewRedactor(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create traffic log directory: %w", err)
+	}
+	return &Recorder{
+		dir:          cfg.Dir,
+		maxBodyBytes: cfg.MaxBodyBytes,
+		maxTotal:     int64(cfg.MaxTotalMB) << 20,
+		redactor:     redactor,
+	}, nil
+}
+
+// Start begins recording the request with the given ID.
+func (r *Recorder) Start(requestID string) *Recording {
+	if r == nil {
+		return nil
+	}
+	r.maybePrune()
+	name := time.Now().UTC().Format("20060102T150405.000Z") + "-" + requestID + ".jsonl"
+	return &Recording{recorder: r, requestID: requestID, path: filepath.Join(r.dir, name)}
+}
+
+// Recording appends the entries of one request to its own file.
+type Recording struct {
+	recorder  *Recorder
+	requestID string
+	path      string
+
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+// Request records the downstream request.
+func (rec *Recording) Request(headers map[string][]string, body []byte) {
+	if rec == nil {
+		return
+	}
+	rec.write(Entry{Kind: KindRequest, Headers: rec.recorder.redactor.Headers(headers)}, body)
+}
+
+// UpstreamRequest records the request sent to CodeWhisperer with an account.
+func (rec *Recording) UpstreamRequest(account string, body []byte) {
+	if rec == nil {
+		return
+	}
+	rec.write(Entry{Kind: KindUpstreamRequest, Account: account}, body)
+}
+
+// UpstreamFrame records the payload of one upstream event-stream frame,
+// or an upstream error response.
+func (rec *Recording) UpstreamFrame(status int, payload []byte) {
+	if rec == nil {
+		return
+	}
+	rec.write(Entry{Kind: KindUpstreamFrame, Status: status}, payload)
+}
+
+// Response records the complete response of a non-streaming request.
+func (rec *Recording) Response(status int, body []byte) {
+	if rec == nil {
+		return
+	}
+	rec.write(Entry{Kind: KindResponse, Status: status}, body)
+}
+
+// ResponseEvent records one SSE event sent to the client.
+func (rec *Recording) ResponseEvent(event string, data []byte) {
+	if rec == nil {
+		return
+	}
+	rec.write(Entry{Kind: KindResponseEvent, Event: event}, data)
+}
+
+// Close closes the traffic file.
+func (rec *Recording) Close() error {
+	if rec == nil {
+		return nil
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		return nil
+	}
+	err := rec.file.Close()
+	rec.file = nil
+	return err
+}
+
+func (rec *Recording) write(entry Entry, body []byte) {
+	entry.Time = time.Now().UTC()
+	entry.RequestID = rec.requestID
+	entry.Body, entry.Truncated = rec.recorder.body(body)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.err != nil {
+		return
+	}
+	if rec.file == nil {
+		rec.file, rec.err = os.OpenFile(rec.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if rec.err != nil {
+			slog.Error("Failed to open traffic log", "path", rec.path, "error", rec.err)
+			return
+		}
+	}
+	if _, err := rec.file.Write(append(line, '\n')); err != nil {
+		rec.err = err
+		slog.Error("Failed to write traffic log", "path", rec.path, "error", err)
+	}
+}
+
+// body redacts and caps a recorded body.
+func (r *Recorder) body(data []byte) (any, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	s := r.redactor.String(string(data))
+	truncated := false
+	if r.maxBodyBytes > 0 && len(s) > r.maxBodyBytes {
+		s = strings.ToValidUTF8(s[:r.maxBodyBytes], "")
+		truncated = true
+	}
+	if !truncated && json.Valid([]byte(s)) {
+		return json.RawMessage(s), false
+	}
+	return s, truncated
+}
+
+// maybePrune deletes the oldest traffic files once the directory grows
+// past its cap.
+func (r *Recorder) maybePrune() {
+	if r.maxTotal <= 0 {
+		return
+	}
+	r.mu.Lock()
+	if time.Since(r.lastPruned) < pruneInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastPruned = time.Now()
+	r.mu.Unlock()
+
+	go func() {
+		entries, err := os.ReadDir(r.dir)
+		if err != nil {
+			return
+		}
+		// Names start with a timestamp, so newest sorts last.
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() > entries[j].Name() })
+		var total int64
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !strings.HasSuffix(entry.Name(), ".jsonl") {
+				continue
+			}
+			total += info.Size()
+			if total > r.maxTotal {
+				os.Remove(filepath.Join(r.dir, entry.Name()))
+			}
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package traffic
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/shyn/kiro2cc/internal/config"
+)
+
+// Redacted replaces every secret the redactor finds.
+const Redacted = "[REDACTED]"
+
+var (
+	// apiKeyPatterns match credentials that may end up in prompts or
+	// headers: Anthropic, OpenAI and kiro2cc keys, AWS access keys, JWTs
+	// and bearer tokens.
+	apiKeyPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`),
+		regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+`),
+		regexp.MustCompile(`(?i)\bBearer\s+[A-Za-z0-9._~+/\-]+=*`),
+	}
+	// secretFieldPattern matches JSON fields named like secrets. Its two
+	// groups, the field name and the closing quote, are kept.
+	secretFieldPattern = regexp.MustCompile(`(?i)("(?:[a-z_]*_)?(?:api_?key|access_?token|refresh_?token|secret|password)"\s*:\s*")[^"]+(")`)
+	emailPattern       = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+	// sensitiveHeaders are recorded with their whole value redacted.
+	sensitiveHeaders = []string{"Authorization", "X-Api-Key", "Cookie", "Proxy-Authorization"}
+)
+
+// Redactor removes secrets from recorded bodies and headers.
+type Redactor struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	re *regexp.Regexp
+	// keepGroups replaces only what lies between the two capture groups.
+	keepGroups bool
+}
+
+// NewRedactor builds a redactor from the configured rules.
+func NewRedactor(cfg config.RedactConfig) (*Redactor, error) {
+	r := &Redactor{}
+	if cfg.APIKeys {
+		for _, re := range apiKeyPatterns {
+			r.patterns = append(r.patterns, pattern{re: re})
+		}
+		r.patterns = append(r.patterns, pattern{re: secretFieldPattern, keepGroups: true})
+	}
+	if cfg.Emails {
+		r.patterns = append(r.patterns, pattern{re: emailPattern})
+	}
+	for _, expr := range cfg.Patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", expr, err)
+		}
+		r.patterns = append(r.patterns, pattern{re: re})
+	}
+	return r, nil
+}
+
+// String returns s with every match replaced. A redacted JSON field keeps
+// its name and quotes; configured patterns always replace the whole match.
+func (r *Redactor) String(s string) string {
+	for _, p := range r.patterns {
+		if p.keepGroups {
+			s = p.re.ReplaceAllString(s, "${1}"+Redacted+"${2}")
+		} else {
+			s = p.re.ReplaceAllLiteralString(s, Redacted)
+		}
+	}
+	return s
+}
+
+// Headers returns a copy of h that is safe to record.
+func (r *Redactor) Headers(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for name, values := range h {
+		value := strings.Join(values, ", ")
+		for _, sensitive := range sensitiveHeaders {
+			if strings.EqualFold(name, sensitive) {
+				value = Redacted
+			}
+		}
+		out[name] = r.String(value)
+	}
+	return out
+}
@@ -1,8 +1,10 @@
 package translator
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"strings"
 
 	"github.com/shyn/kiro2cc/internal/config"
@@ -11,7 +13,7 @@ import (
 )
 
 type Service interface {
-	ToCodeWhisperer(req *types.AnthropicRequest) (*types.CodeWhispererRequest, error)
+	ToCodeWhisperer(ctx context.Context, req *types.AnthropicRequest) (*types.CodeWhispererRequest, error)
 	FromCodeWhisperer(resp []byte, model string) (map[string]any, error)
 }
 
@@ -25,7 +27,11 @@ func NewService(cfg *config.Config) Service {
 	}
 }
 
-func (s *service) ToCodeWhisperer(anthropicReq *types.AnthropicRequest) (*types.CodeWhispererRequest, error) {
+func (s *service) ToCodeWhisperer(ctx context.Context, anthropicReq *types.AnthropicRequest) (*types.CodeWhispererRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	cwReq := &types.CodeWhispererRequest{
 		ProfileArn: s.config.CodeWhisperer.ProfileArn,
 	}
@@ -33,14 +39,30 @@ func (s *service) ToCodeWhisperer(anthropicReq *types.AnthropicRequest) (*types.
 	cwReq.ConversationState.ChatTriggerType = config.ChatTriggerType
 	cwReq.ConversationState.ConversationId = generateUUID()
 
-	lastMessage := anthropicReq.Messages[len(anthropicReq.Messages)-1]
-	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = getMessageContent(lastMessage.Content)
+	// CodeWhisperer always answers a user turn. A final assistant message
+	// is a prefill, so it goes into the history and the model is asked to
+	// continue it.
+	past := anthropicReq.Messages
+	current := continuePrefill
+	if lastMessage := past[len(past)-1]; lastMessage.Role == "user" {
+		past = past[:len(past)-1]
+		current = getMessageContent(lastMessage.Content)
+	}
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = current
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId = config.ModelMapping[anthropicReq.Model]
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Origin = config.Origin
 
-	if len(anthropicReq.Tools) > 0 {
-		tools := make([]types.CodeWhispererTool, 0, len(anthropicReq.Tools))
-		for _, tool := range anthropicReq.Tools {
+	offered, instruction := toolsFor(anthropicReq)
+	if instruction != "" {
+		current := &cwReq.ConversationState.CurrentMessage.UserInputMessage
+		current.Content += "\n\n<tool_choice>\n" + instruction + "\n</tool_choice>"
+	}
+	if len(offered) > 0 {
+		tools := make([]types.CodeWhispererTool, 0, len(offered))
+		for _, tool := range offered {
+			if !tool.IsCustom() {
+				continue
+			}
 			cwTool := types.CodeWhispererTool{}
 			cwTool.ToolSpecification.Name = tool.Name
 			cwTool.ToolSpecification.Description = tool.Description
@@ -52,42 +74,85 @@ func (s *service) ToCodeWhisperer(anthropicReq *types.AnthropicRequest) (*types.
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools = tools
 	}
 
-	s.buildHistory(cwReq, anthropicReq)
+	s.buildHistory(cwReq, anthropicReq, past)
 
 	return cwReq, nil
 }
 
-func (s *service) buildHistory(cwReq *types.CodeWhispererRequest, anthropicReq *types.AnthropicRequest) {
-	if len(anthropicReq.System) == 0 && len(anthropicReq.Messages) <= 1 {
+// continuePrefill is the user turn that asks the model to continue a
+// prefilled assistant message.
+const continuePrefill = "Continue your last response exactly where it stopped, without repeating any of it."
+
+// toolsFor returns the tools to offer under the request's tool_choice and,
+// since CodeWhisperer has no such parameter, an instruction that asks the
+// model to follow it.
+func toolsFor(req *types.AnthropicRequest) ([]types.AnthropicTool, string) {
+	choice := req.ToolChoice
+	if choice == nil || len(req.Tools) == 0 {
+		return req.Tools, ""
+	}
+
+	tools := req.Tools
+	var rules []string
+	switch choice.Type {
+	case "none":
+		return nil, ""
+	case "any":
+		rules = append(rules, "You must respond by calling at least one of the available tools, not with text alone.")
+	case "tool":
+		for _, tool := range req.Tools {
+			if tool.Name == choice.Name {
+				tools = []types.AnthropicTool{tool}
+			}
+		}
+		rules = append(rules, fmt.Sprintf("You must respond by calling the %s tool.", choice.Name))
+	}
+	if choice.DisableParallelToolUse != nil && *choice.DisableParallelToolUse {
+		rules = append(rules, "Call at most one tool in this response.")
+	}
+	return tools, strings.Join(rules, " ")
+}
+
+// buildHistory sends the messages before the current one as the history.
+func (s *service) buildHistory(cwReq *types.CodeWhispererRequest, anthropicReq *types.AnthropicRequest, past []types.AnthropicRequestMessage) {
+	system := anthropicReq.System.Text()
+	legacySystem := system != "" && s.config.CodeWhisperer.SystemPrompt == config.SystemPromptHistory
+	if !legacySystem && len(past) == 0 {
+		if system != "" {
+			current := &cwReq.ConversationState.CurrentMessage.UserInputMessage
+			current.Content = withSystemPrompt(system, current.Content)
+		}
 		return
 	}
 
 	var history []any
 
-	assistantDefaultMsg := types.HistoryAssistantMessage{}
-	assistantDefaultMsg.AssistantResponseMessage.Content = config.SystemMessageResponse
-	assistantDefaultMsg.AssistantResponseMessage.ToolUses = make([]any, 0)
+	if legacySystem {
+		assistantDefaultMsg := types.HistoryAssistantMessage{}
+		assistantDefaultMsg.AssistantResponseMessage.Content = config.SystemMessageResponse
+		assistantDefaultMsg.AssistantResponseMessage.ToolUses = make([]any, 0)
 
-	for _, sysMsg := range anthropicReq.System {
-		userMsg := types.HistoryUserMessage{}
-		userMsg.UserInputMessage.Content = sysMsg.Text
-		userMsg.UserInputMessage.ModelId = config.ModelMapping[anthropicReq.Model]
-		userMsg.UserInputMessage.Origin = config.Origin
-		history = append(history, userMsg)
-		history = append(history, assistantDefaultMsg)
+		for _, sysMsg := range anthropicReq.System {
+			userMsg := types.HistoryUserMessage{}
+			userMsg.UserInputMessage.Content = sysMsg.Text
+			userMsg.UserInputMessage.ModelId = config.ModelMapping[anthropicReq.Model]
+			userMsg.UserInputMessage.Origin = config.Origin
+			history = append(history, userMsg)
+			history = append(history, assistantDefaultMsg)
+		}
 	}
 
-	for i := 0; i < len(anthropicReq.Messages)-1; i++ {
-		if anthropicReq.Messages[i].Role == "user" {
+	for i := 0; i < len(past); i++ {
+		if past[i].Role == "user" {
 			userMsg := types.HistoryUserMessage{}
-			userMsg.UserInputMessage.Content = getMessageContent(anthropicReq.Messages[i].Content)
+			userMsg.UserInputMessage.Content = getMessageContent(past[i].Content)
 			userMsg.UserInputMessage.ModelId = config.ModelMapping[anthropicReq.Model]
 			userMsg.UserInputMessage.Origin = config.Origin
 			history = append(history, userMsg)
 
-			if i+1 < len(anthropicReq.Messages)-1 && anthropicReq.Messages[i+1].Role == "assistant" {
+			if i+1 < len(past) && past[i+1].Role == "assistant" {
 				assistantMsg := types.HistoryAssistantMessage{}
-				assistantMsg.AssistantResponseMessage.Content = getMessageContent(anthropicReq.Messages[i+1].Content)
+				assistantMsg.AssistantResponseMessage.Content = getMessageContent(past[i+1].Content)
 				assistantMsg.AssistantResponseMessage.ToolUses = make([]any, 0)
 				history = append(history, assistantMsg)
 				i++
@@ -95,9 +160,36 @@ func (s *service) buildHistory(cwReq *types.CodeWhispererRequest, anthropicReq *
 		}
 	}
 
+	if system != "" && !legacySystem {
+		prependSystemPrompt(cwReq, history, system)
+	}
 	cwReq.ConversationState.History = history
 }
 
+// prependSystemPrompt adds the system prompt to the first user message of
+// the conversation, so it comes before everything it governs.
+//
+// Injecting it as text is the only option: CodeWhisperer's conversation
+// state holds nothing but user and assistant turns, and the context of a
+// user turn only carries tools and tool results, so there is no native
+// field a system prompt could go in.
+func prependSystemPrompt(cwReq *types.CodeWhispererRequest, history []any, system string) {
+	for i, msg := range history {
+		if userMsg, ok := msg.(types.HistoryUserMessage); ok {
+			userMsg.UserInputMessage.Content = withSystemPrompt(system, userMsg.UserInputMessage.Content)
+			history[i] = userMsg
+			return
+		}
+	}
+	current := &cwReq.ConversationState.CurrentMessage.UserInputMessage
+	current.Content = withSystemPrompt(system, current.Content)
+}
+
+// withSystemPrompt marks the system prompt off from the user's message.
+func withSystemPrompt(system, content string) string {
+	return "<system_prompt>\n" + system + "\n</system_prompt>\n\n" + content
+}
+
 func (s *service) FromCodeWhisperer(resp []byte, model string) (map[string]any, error) {
 	respBodyStr := string(resp)
 
@@ -111,7 +203,7 @@ func (s *service) FromCodeWhisperer(resp []byte, model string) (map[string]any,
 
 	events := parser.ParseEvents(resp)
 
-	context := ""
+	text := ""
 	toolName := ""
 	toolUseId := ""
 	contexts := []map[string]any{}
@@ -121,15 +213,13 @@ func (s *service) FromCodeWhisperer(resp []byte, model string) (map[string]any,
 		if event.Data != nil {
 			if dataMap, ok := event.Data.(map[string]any); ok {
 				switch dataMap["type"] {
-				case "content_block_start":
-					context = ""
 				case "content_block_delta":
 					if delta, ok := dataMap["delta"]; ok {
 						if deltaMap, ok := delta.(map[string]any); ok {
 							switch deltaMap["type"] {
 							case "text_delta":
-								if text, ok := deltaMap["text"]; ok {
-									context += text.(string)
+								if delta, ok := deltaMap["text"]; ok {
+									text += delta.(string)
 								}
 							case "input_json_delta":
 								toolUseId = deltaMap["id"].(string)
@@ -140,38 +230,38 @@ func (s *service) FromCodeWhisperer(resp []byte, model string) (map[string]any,
 									} else if str, ok := partialJson.(string); ok {
 										partialJsonStr += str
 									} else {
-										log.Println("partial_json is not string or *string")
+										slog.Warn("partial_json is not string or *string")
 									}
 								}
 							}
 						}
 					}
 				case "content_block_stop":
-					if index, ok := dataMap["index"]; ok {
-						switch index {
-						case 1:
-							toolInput := map[string]interface{}{}
-							if err := json.Unmarshal([]byte(partialJsonStr), &toolInput); err != nil {
-								log.Printf("json unmarshal error: %s", err.Error())
-							}
-							contexts = append(contexts, map[string]interface{}{
-								"type":  "tool_use",
-								"id":    toolUseId,
-								"name":  toolName,
-								"input": toolInput,
-							})
-						case 0:
-							contexts = append(contexts, map[string]interface{}{
-								"text": context,
-								"type": "text",
-							})
+					// Upstream only ends tool calls, at index 1.
+					if index, ok := dataMap["index"]; ok && index == 1 {
+						toolInput := map[string]interface{}{}
+						if err := json.Unmarshal([]byte(partialJsonStr), &toolInput); err != nil {
+							slog.Warn("Failed to parse tool input", "error", err)
 						}
+						contexts = append(contexts, map[string]interface{}{
+							"type":  "tool_use",
+							"id":    toolUseId,
+							"name":  toolName,
+							"input": toolInput,
+						})
+						partialJsonStr = ""
 					}
 				}
 			}
 		}
 	}
 
+	// The text arrives as one block that upstream never ends, ahead of any
+	// tool calls.
+	if text != "" {
+		contexts = append([]map[string]any{{"type": "text", "text": text}}, contexts...)
+	}
+
 	return map[string]any{
 		"content":       contexts,
 		"model":         model,
@@ -180,8 +270,8 @@ func (s *service) FromCodeWhisperer(resp []byte, model string) (map[string]any,
 		"stop_sequence": nil,
 		"type":          "message",
 		"usage": map[string]any{
-			"input_tokens":  len(context),
-			"output_tokens": len(context),
+			"input_tokens":  len(text),
+			"output_tokens": len(text),
 		},
 	}, nil
 }
@@ -0,0 +1,178 @@
+package translator
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/shyn/kiro2cc/internal/config"
+	"github.com/shyn/kiro2cc/pkg/types"
+)
+
+// translate converts a request body with the given system prompt
+// strategy.
+func translate(t *testing.T, strategy, body string) *types.CodeWhispererRequest {
+	t.Helper()
+	var req types.AnthropicRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(&config.Config{CodeWhisperer: config.CodeWhispererConfig{SystemPrompt: strategy}})
+	cwReq, err := svc.ToCodeWhisperer(context.Background(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cwReq
+}
+
+// turns lists the history as "user: ..." and "assistant: ..." lines.
+func turns(history []any) []string {
+	var out []string
+	for _, msg := range history {
+		switch m := msg.(type) {
+		case types.HistoryUserMessage:
+			out = append(out, "user: "+m.UserInputMessage.Content)
+		case types.HistoryAssistantMessage:
+			out = append(out, "assistant: "+m.AssistantResponseMessage.Content)
+		}
+	}
+	return out
+}
+
+func TestSystemPrompt(t *testing.T) {
+	const wrapped = "<system_prompt>\nbe brief\n</system_prompt>\n\n"
+	tests := []struct {
+		name     string
+		strategy string
+		body     string
+		current  string
+		history  []string
+	}{
+		{
+			name:    "string",
+			body:    `{"system":"be brief","messages":[{"role":"user","content":"hi"}]}`,
+			current: wrapped + "hi",
+		},
+		{
+			name:    "array",
+			body:    `{"system":[{"type":"text","text":"be"},{"type":"text","text":"brief"}],"messages":[{"role":"user","content":"hi"}]}`,
+			current: "<system_prompt>\nbe\n\nbrief\n</system_prompt>\n\nhi",
+		},
+		{
+			name:    "empty",
+			body:    `{"system":"","messages":[{"role":"user","content":"hi"}]}`,
+			current: "hi",
+		},
+		{
+			name:    "empty blocks",
+			body:    `{"system":[],"messages":[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"c"}]}`,
+			current: "c",
+			history: []string{"user: a", "assistant: b"},
+		},
+		{
+			name:    "first of several turns",
+			body:    `{"system":"be brief","messages":[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"c"}]}`,
+			current: "c",
+			history: []string{"user: " + wrapped + "a", "assistant: b"},
+		},
+		{
+			name:    "starts with an assistant turn",
+			body:    `{"system":"be brief","messages":[{"role":"assistant","content":"How can I help?"},{"role":"user","content":"hi"}]}`,
+			current: wrapped + "hi",
+		},
+		{
+			name: "starts with a tool turn",
+			body: `{"system":"be brief","messages":[
+				{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"get_weather","input":{}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"sunny"}]},
+				{"role":"assistant","content":"It is sunny."},
+				{"role":"user","content":"thanks"}]}`,
+			current: "thanks",
+			history: []string{"user: " + wrapped + "sunny", "assistant: It is sunny."},
+		},
+		{
+			name:     "history strategy",
+			strategy: config.SystemPromptHistory,
+			body:     `{"system":"be brief","messages":[{"role":"user","content":"hi"}]}`,
+			current:  "hi",
+			history:  []string{"user: be brief", "assistant: " + config.SystemMessageResponse},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := tt.strategy
+			if strategy == "" {
+				strategy = config.SystemPromptPrepend
+			}
+			cwReq := translate(t, strategy, tt.body)
+			if got := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; got != tt.current {
+				t.Errorf("current message = %q, want %q", got, tt.current)
+			}
+			if got := turns(cwReq.ConversationState.History); !reflect.DeepEqual(got, tt.history) {
+				t.Errorf("history = %q, want %q", got, tt.history)
+			}
+		})
+	}
+}
+
+func TestToolsFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		choice      string
+		tools       []string
+		instruction string
+	}{
+		{"unset", ``, []string{"get_weather", "search"}, ""},
+		{"auto", `,"tool_choice":{"type":"auto"}`, []string{"get_weather", "search"}, ""},
+		{"none", `,"tool_choice":{"type":"none"}`, nil, ""},
+		{"any", `,"tool_choice":{"type":"any"}`, []string{"get_weather", "search"},
+			"You must respond by calling at least one of the available tools, not with text alone."},
+		{"tool", `,"tool_choice":{"type":"tool","name":"search"}`, []string{"search"},
+			"You must respond by calling the search tool."},
+		{"no parallel calls", `,"tool_choice":{"type":"auto","disable_parallel_tool_use":true}`, []string{"get_weather", "search"},
+			"Call at most one tool in this response."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cwReq := translate(t, config.SystemPromptPrepend, `{"messages":[{"role":"user","content":"hi"}],
+				"tools":[{"name":"get_weather","input_schema":{}},{"name":"search","input_schema":{}}]`+tt.choice+`}`)
+			current := cwReq.ConversationState.CurrentMessage.UserInputMessage
+
+			var tools []string
+			for _, tool := range current.UserInputMessageContext.Tools {
+				tools = append(tools, tool.ToolSpecification.Name)
+			}
+			if !reflect.DeepEqual(tools, tt.tools) {
+				t.Errorf("tools = %q, want %q", tools, tt.tools)
+			}
+
+			want := "hi"
+			if tt.instruction != "" {
+				want += "\n\n<tool_choice>\n" + tt.instruction + "\n</tool_choice>"
+			}
+			if current.Content != want {
+				t.Errorf("current message = %q, want %q", current.Content, want)
+			}
+		})
+	}
+}
+
+func TestPrefill(t *testing.T) {
+	cwReq := translate(t, config.SystemPromptPrepend, `{"system":"be brief","messages":[
+		{"role":"user","content":"List three colors as JSON."},
+		{"role":"assistant","content":"{\"colors\": ["}]}`)
+
+	if got := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; got != continuePrefill {
+		t.Errorf("current message = %q, want the request to continue", got)
+	}
+	want := []string{
+		"user: <system_prompt>\nbe brief\n</system_prompt>\n\nList three colors as JSON.",
+		`assistant: {"colors": [`,
+	}
+	if got := turns(cwReq.ConversationState.History); !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
@@ -3,7 +3,7 @@ package translator
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"strings"
 
@@ -48,20 +48,19 @@ func getMessageContent(content any) string {
 			}
 		}
 		if len(texts) == 0 {
-			s, err := json.Marshal(content)
-			if err != nil {
-				return config.DefaultFallbackContent
+			// Only the shape is logged, the content may hold secrets.
+			blockTypes := make([]string, 0, len(v))
+			for _, block := range v {
+				m, _ := block.(map[string]interface{})
+				blockType, _ := m["type"].(string)
+				blockTypes = append(blockTypes, blockType)
 			}
-			log.Printf("uncatch: %s", string(s))
+			slog.Debug("Unhandled message content, using fallback", "block_types", blockTypes)
 			return config.DefaultFallbackContent
 		}
 		return strings.Join(texts, "\n")
 	default:
-		s, err := json.Marshal(content)
-		if err != nil {
-			return config.DefaultFallbackContent
-		}
-		log.Printf("uncatch: %s", string(s))
+		slog.Debug("Unhandled message content, using fallback", "content_type", fmt.Sprintf("%T", content))
 		return config.DefaultFallbackContent
 	}
 }
\ No newline at end of file
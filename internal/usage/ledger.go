@@ -0,0 +1,114 @@
+// Package usage keeps a ledger of completed requests in a JSONL file and
+// aggregates it into reports.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ProjectHeader names the project a request was made for. kiro2cc claude
+// sets it to the working directory, percent-encoded so that non-ASCII
+// paths survive HTTP clients.
+const ProjectHeader = "x-kiro2cc-project"
+
+// Record is one line of the ledger.
+type Record struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Model     string    `json:"model"`
+	Stream    bool      `json:"stream"`
+	Status    int       `json:"status"`
+	// Error is the error type of a stream that failed after its 200
+	// response had been sent.
+	Error        string `json:"error,omitempty"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	LatencyMS    int64  `json:"latency_ms"`
+	// APIKey is the ID of the local API key that made the request.
+	APIKey  string `json:"api_key,omitempty"`
+	Project string `json:"project,omitempty"`
+}
+
+// Failed reports whether the request did not complete successfully.
+func (r Record) Failed() bool {
+	return r.Status >= 400 || r.Error != ""
+}
+
+// Ledger appends records to a file. A nil *Ledger discards them.
+type Ledger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the ledger at path for appending, creating it if needed.
+func Open(path string) (*Ledger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create usage ledger directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage ledger: %w", err)
+	}
+	return &Ledger{file: f}, nil
+}
+
+// Append writes one record as a single line.
+func (l *Ledger) Append(r Record) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Read returns the records at path made at or after since. Lines that
+// cannot be parsed, such as one cut short by a crash, are skipped.
+func Read(path string, since time.Time) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if r.Time.Before(since) {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return records, nil
+}
@@ -0,0 +1,102 @@
+package usage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dimensions a report can group by.
+const (
+	ByDay     = "day"
+	ByModel   = "model"
+	ByKey     = "key"
+	ByProject = "project"
+)
+
+// Row is the total of the records that share the grouped dimensions.
+// Dimensions that are not grouped by are empty.
+type Row struct {
+	Day          string `json:"day,omitempty"`
+	Model        string `json:"model,omitempty"`
+	APIKey       string `json:"apiKey,omitempty"`
+	Project      string `json:"project,omitempty"`
+	Requests     int    `json:"requests"`
+	Errors       int    `json:"errors"`
+	InputTokens  int    `json:"inputTokens"`
+	OutputTokens int    `json:"outputTokens"`
+	// AvgLatencyMS is the mean time to serve a request, streams included.
+	AvgLatencyMS int64 `json:"avgLatencyMs"`
+}
+
+// ParseGroupBy parses a comma-separated list of dimensions.
+func ParseGroupBy(value string) ([]string, error) {
+	var by []string
+	for _, dim := range strings.Split(value, ",") {
+		dim = strings.TrimSpace(dim)
+		switch dim {
+		case ByDay, ByModel, ByKey, ByProject:
+			by = append(by, dim)
+		case "":
+		default:
+			return nil, fmt.Errorf("cannot group usage by %q, use day, model, key or project", dim)
+		}
+	}
+	return by, nil
+}
+
+// Aggregate groups records by the given dimensions, with days in loc.
+// Rows are sorted by their dimensions, days first.
+func Aggregate(records []Record, by []string, loc *time.Location) []Row {
+	rows := make(map[Row]*Row)
+	latency := make(map[Row]int64)
+	for _, r := range records {
+		var key Row
+		for _, dim := range by {
+			switch dim {
+			case ByDay:
+				key.Day = r.Time.In(loc).Format("2006-01-02")
+			case ByModel:
+				key.Model = r.Model
+			case ByKey:
+				key.APIKey = r.APIKey
+			case ByProject:
+				key.Project = r.Project
+			}
+		}
+
+		row, ok := rows[key]
+		if !ok {
+			row = &Row{Day: key.Day, Model: key.Model, APIKey: key.APIKey, Project: key.Project}
+			rows[key] = row
+		}
+		row.Requests++
+		if r.Failed() {
+			row.Errors++
+		}
+		row.InputTokens += r.InputTokens
+		row.OutputTokens += r.OutputTokens
+		latency[key] += r.LatencyMS
+	}
+
+	out := make([]Row, 0, len(rows))
+	for key, row := range rows {
+		row.AvgLatencyMS = latency[key] / int64(row.Requests)
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		if a.APIKey != b.APIKey {
+			return a.APIKey < b.APIKey
+		}
+		return a.Project < b.Project
+	})
+	return out
+}
@@ -0,0 +1,79 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLedgerRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, model := range []string{"claude-sonnet-4", "claude-3-7-sonnet"} {
+		if err := l.Append(Record{Time: base.Add(time.Duration(i) * time.Hour), Model: model, Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line cut short by a crash must not hide the others.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"time":"2026-03-01T`)
+	f.Close()
+
+	records, err := Read(path, base.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Model != "claude-3-7-sonnet" {
+		t.Fatalf("Read() = %+v, want only the record after since", records)
+	}
+
+	if records, err := Read(filepath.Join(t.TempDir(), "missing.jsonl"), time.Time{}); err != nil || records != nil {
+		t.Fatalf("Read() of a missing ledger = %v, %v, want no records", records, err)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	day1 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	records := []Record{
+		{Time: day1, Model: "sonnet", APIKey: "k1", Status: 200, InputTokens: 10, OutputTokens: 5, LatencyMS: 100},
+		{Time: day1, Model: "sonnet", APIKey: "k1", Status: 200, InputTokens: 20, OutputTokens: 15, LatencyMS: 300},
+		{Time: day1, Model: "sonnet", APIKey: "k2", Status: 500, LatencyMS: 50},
+		{Time: day2, Model: "haiku", APIKey: "k1", Status: 200, Error: "api_error", OutputTokens: 1, LatencyMS: 10},
+	}
+
+	got := Aggregate(records, []string{ByDay, ByKey}, time.UTC)
+	want := []Row{
+		{Day: "2026-03-01", APIKey: "k1", Requests: 2, InputTokens: 30, OutputTokens: 20, AvgLatencyMS: 200},
+		{Day: "2026-03-01", APIKey: "k2", Requests: 1, Errors: 1, AvgLatencyMS: 50},
+		{Day: "2026-03-02", APIKey: "k1", Requests: 1, Errors: 1, OutputTokens: 1, AvgLatencyMS: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Aggregate(day, key) =\n%+v\nwant\n%+v", got, want)
+	}
+
+	got = Aggregate(records, []string{ByModel}, time.UTC)
+	if len(got) != 2 || got[0].Model != "haiku" || got[1].Model != "sonnet" || got[1].Requests != 3 {
+		t.Fatalf("Aggregate(model) = %+v", got)
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	by, err := ParseGroupBy("day, model,key")
+	if err != nil || !reflect.DeepEqual(by, []string{ByDay, ByModel, ByKey}) {
+		t.Fatalf("ParseGroupBy() = %v, %v", by, err)
+	}
+	if _, err := ParseGroupBy("day,colour"); err == nil {
+		t.Fatal("ParseGroupBy() accepted an unknown dimension")
+	}
+}
@@ -0,0 +1,5 @@
+// Package version holds the kiro2cc version. Release builds set it with
+// -ldflags "-X github.com/shyn/kiro2cc/internal/version.Version=<version>".
+package version
+
+var Version = "dev"
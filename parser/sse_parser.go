@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
-	"strings"
+	"log/slog"
 )
 
 type assistantResponseEvent struct {
@@ -22,72 +22,94 @@ type SSEEvent struct {
 	Data  interface{} `json:"data"`
 }
 
-func ParseEvents(resp []byte) []SSEEvent {
+// maxFrameLen guards against allocating huge buffers for a corrupt
+// frame length.
+const maxFrameLen = 16 << 20
 
-	events := []SSEEvent{}
+var ErrInvalidFrame = errors.New("frame length invalid")
 
-	r := bytes.NewReader(resp)
-	for {
-		if r.Len() < 12 {
-			break
-		}
+// Decoder reads CodeWhisperer event-stream frames from an upstream
+// response as they arrive.
+type Decoder struct {
+	r       io.Reader
+	payload []byte
+}
 
-		var totalLen, headerLen uint32
-		if err := binary.Read(r, binary.BigEndian, &totalLen); err != nil {
-			break
-		}
-		if err := binary.Read(r, binary.BigEndian, &headerLen); err != nil {
-			break
-		}
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
 
-		if int(totalLen) > r.Len()+8 {
-			log.Println("Frame length invalid")
-			break
+// Next reads one frame and returns the SSE events it translates to, which
+// may be none. It returns io.EOF once the stream ends cleanly.
+func (d *Decoder) Next() ([]SSEEvent, error) {
+	// Prelude: total length, headers length, prelude CRC32.
+	var prelude [12]byte
+	if _, err := io.ReadFull(d.r, prelude[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			slog.Warn("Frame truncated")
 		}
+		return nil, err
+	}
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headerLen := binary.BigEndian.Uint32(prelude[4:8])
+	if totalLen < 16 || totalLen > maxFrameLen || headerLen > totalLen-16 {
+		slog.Warn("Frame length invalid", "total", totalLen, "headers", headerLen)
+		return nil, ErrInvalidFrame
+	}
 
-		// Skip header
-		header := make([]byte, headerLen)
-		if _, err := io.ReadFull(r, header); err != nil {
-			break
-		}
+	// Headers, payload and the message CRC32, which are not checked.
+	frame := make([]byte, totalLen-12)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		slog.Warn("Frame truncated")
+		return nil, err
+	}
+	payload := frame[headerLen : len(frame)-4]
+	d.payload = payload
 
-		payloadLen := int(totalLen) - int(headerLen) - 12
-		payload := make([]byte, payloadLen)
-		if _, err := io.ReadFull(r, payload); err != nil {
-			break
-		}
+	var evt assistantResponseEvent
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		slog.Warn("Failed to parse CodeWhisperer event", "error", err)
+		return nil, nil
+	}
 
-		// Skip CRC32
-		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
-			break
+	events := []SSEEvent{convertAssistantEventToSSE(evt)}
+
+	if evt.ToolUseId != "" && evt.Name != "" {
+		if evt.Stop {
+			events = append(events, SSEEvent{
+				Event: "message_delta",
+				Data: map[string]interface{}{
+					"type": "message_delta",
+					"delta": map[string]interface{}{
+						"stop_reason":   "tool_use",
+						"stop_sequence": nil,
+					},
+					"usage": map[string]interface{}{"output_tokens": 0},
+				},
+			})
 		}
 
-		payloadStr := strings.TrimPrefix(string(payload), "vent")
+	}
+
+	return events, nil
+}
 
-		var evt assistantResponseEvent
-		if err := json.Unmarshal([]byte(payloadStr), &evt); err == nil {
+// Payload returns the raw payload of the frame last read by Next.
+func (d *Decoder) Payload() []byte {
+	return d.payload
+}
 
-			events = append(events, convertAssistantEventToSSE(evt))
+func ParseEvents(resp []byte) []SSEEvent {
 
-			if evt.ToolUseId != "" && evt.Name != "" {
-				if evt.Stop {
-					events = append(events, SSEEvent{
-						Event: "message_delta",
-						Data: map[string]interface{}{
-							"type": "message_delta",
-							"delta": map[string]interface{}{
-								"stop_reason":   "tool_use",
-								"stop_sequence": nil,
-							},
-							"usage": map[string]interface{}{"output_tokens": 0},
-						},
-					})
-				}
+	events := []SSEEvent{}
 
-			}
-		} else {
-			log.Println("json unmarshal error:", err)
+	d := NewDecoder(bytes.NewReader(resp))
+	for {
+		frameEvents, err := d.Next()
+		if err != nil {
+			break
 		}
+		events = append(events, frameEvents...)
 	}
 
 	return events
@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"testing"
 )
@@ -22,3 +25,52 @@ func TestParseCodeWhispererEvents(t *testing.T) {
 		fmt.Printf("data: %s\n\n", string(json))
 	}
 }
+
+// frame builds an event-stream frame with an empty header section.
+func frame(payload string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(16+len(payload)))
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // prelude CRC, unchecked
+	buf.WriteString(payload)
+	binary.Write(&buf, binary.BigEndian, uint32(0)) // message CRC, unchecked
+	return buf.Bytes()
+}
+
+func TestDecoderReadsFramesIncrementally(t *testing.T) {
+	r, w := io.Pipe()
+	d := NewDecoder(r)
+
+	go func() {
+		// Split the first frame mid-prelude to mimic a slow upstream.
+		first := frame(`{"content":"Hello"}`)
+		w.Write(first[:5])
+		w.Write(first[5:])
+		w.Write(frame(`{"content":" world"}`))
+		w.Close()
+	}()
+
+	for _, want := range []string{"Hello", " world"} {
+		events, err := d.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Event != "content_block_delta" {
+			t.Fatalf("Next() = %+v, want one content_block_delta", events)
+		}
+		delta := events[0].Data.(map[string]interface{})["delta"].(map[string]interface{})
+		if delta["text"] != want {
+			t.Fatalf("text = %q, want %q", delta["text"], want)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("Next() at end = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderRejectsInvalidLength(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(make([]byte, 12)))
+	if _, err := d.Next(); err != ErrInvalidFrame {
+		t.Fatalf("Next() = %v, want ErrInvalidFrame", err)
+	}
+}
@@ -1,9 +1,18 @@
 package types
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
 type TokenData struct {
-	AccessToken  string `json:"accessToken"`
-	RefreshToken string `json:"refreshToken"`
-	ExpiresAt    string `json:"expiresAt,omitempty"`
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	ExpiresAt    string    `json:"expiresAt,omitempty"`
+	Region       string    `json:"region,omitempty"`
+	ProfileArn   string    `json:"profileArn,omitempty"`
+	Profiles     []Profile `json:"profiles,omitempty"`
 }
 
 type RefreshRequest struct {
@@ -14,12 +23,54 @@ type RefreshResponse struct {
 	AccessToken  string `json:"accessToken"`
 	RefreshToken string `json:"refreshToken"`
 	ExpiresAt    string `json:"expiresAt,omitempty"`
+	ProfileArn   string `json:"profileArn,omitempty"`
+}
+
+type Profile struct {
+	Arn         string `json:"arn"`
+	ProfileName string `json:"profileName"`
+}
+
+type ListAvailableProfilesRequest struct {
+	MaxResults int     `json:"maxResults,omitempty"`
+	NextToken  *string `json:"nextToken,omitempty"`
+}
+
+type ListAvailableProfilesResponse struct {
+	Profiles  []Profile `json:"profiles"`
+	NextToken *string   `json:"nextToken,omitempty"`
 }
 
 type AnthropicTool struct {
-	Name        string         `json:"name"`
-	Description string         `json:"description"`
-	InputSchema map[string]any `json:"input_schema"`
+	// Type is empty or "custom" for client tools. Server tools such as
+	// web search have a versioned type and no input schema; CodeWhisperer
+	// cannot run them, so they are not forwarded.
+	Type         string         `json:"type,omitempty"`
+	Name         string         `json:"name"`
+	Description  string         `json:"description,omitempty"`
+	InputSchema  map[string]any `json:"input_schema,omitempty"`
+	CacheControl map[string]any `json:"cache_control,omitempty"`
+}
+
+// IsCustom reports whether the tool is a client tool with an input schema.
+func (t AnthropicTool) IsCustom() bool {
+	return t.Type == "" || t.Type == "custom"
+}
+
+// AnthropicToolChoice is how the model should use the tools.
+type AnthropicToolChoice struct {
+	// Type is auto, any, tool or none.
+	Type string `json:"type"`
+	// Name is the tool to use when Type is tool.
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse *bool  `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// AnthropicThinking configures extended thinking.
+type AnthropicThinking struct {
+	// Type is enabled or disabled.
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
 }
 
 type InputSchema struct {
@@ -51,15 +102,34 @@ type HistoryAssistantMessage struct {
 	} `json:"assistantResponseMessage"`
 }
 
+// AnthropicRequest is the body of POST /v1/messages. CodeWhisperer has no
+// counterpart for most sampling parameters; each field notes what the
+// proxy does with it.
 type AnthropicRequest struct {
-	Model       string                    `json:"model"`
-	MaxTokens   int                       `json:"max_tokens"`
-	Messages    []AnthropicRequestMessage `json:"messages"`
-	System      []AnthropicSystemMessage  `json:"system,omitempty"`
-	Tools       []AnthropicTool           `json:"tools,omitempty"`
-	Stream      bool                      `json:"stream"`
-	Temperature *float64                  `json:"temperature,omitempty"`
-	Metadata    map[string]any            `json:"metadata,omitempty"`
+	Model    string                    `json:"model"`
+	Messages []AnthropicRequestMessage `json:"messages"`
+	// MaxTokens is required. It is not sent upstream; the proxy cuts the
+	// response once its estimated output reaches it.
+	MaxTokens int             `json:"max_tokens"`
+	System    AnthropicSystem `json:"system,omitempty"`
+	Tools     []AnthropicTool `json:"tools,omitempty"`
+	// ToolChoice is not sent upstream. The proxy offers only the tools it
+	// allows, asks the model to follow it and drops tool calls it forbids.
+	ToolChoice *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Stream     bool                 `json:"stream"`
+	// StopSequences are not sent upstream; the proxy cuts the response at
+	// the first one itself.
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	// Temperature, TopP and TopK are validated and ignored: CodeWhisperer
+	// does not take sampling parameters.
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	TopK        *int     `json:"top_k,omitempty"`
+	// Thinking is validated and ignored; no thinking blocks are returned.
+	Thinking *AnthropicThinking `json:"thinking,omitempty"`
+	// ServiceTier and Metadata are accepted and ignored.
+	ServiceTier string         `json:"service_tier,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
 }
 
 type AnthropicStreamResponse struct {
@@ -91,6 +161,38 @@ type AnthropicSystemMessage struct {
 	Text string `json:"text"`
 }
 
+// AnthropicSystem is the system prompt, which the API accepts either as a
+// string or as an array of text blocks.
+type AnthropicSystem []AnthropicSystemMessage
+
+func (s *AnthropicSystem) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = nil
+		if text != "" {
+			*s = AnthropicSystem{{Type: "text", Text: text}}
+		}
+		return nil
+	}
+	var blocks []AnthropicSystemMessage
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return errors.New("system must be a string or an array of text blocks")
+	}
+	*s = blocks
+	return nil
+}
+
+// Text joins the text of the blocks with blank lines.
+func (s AnthropicSystem) Text() string {
+	texts := make([]string, 0, len(s))
+	for _, block := range s {
+		if block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
 type ContentBlock struct {
 	Type      string  `json:"type"`
 	Text      *string `json:"text,omitempty"`
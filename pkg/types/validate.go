@@ -0,0 +1,204 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ValidationError is the first problem found in a request. Field is named
+// the way the Anthropic API names it, such as "messages.0.content".
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+func invalid(field, format string, args ...any) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+// Validate checks the request against the Messages API schema. It returns
+// a *ValidationError for the first problem found.
+func (r *AnthropicRequest) Validate() error {
+	if r.Model == "" {
+		return invalid("model", "Field required")
+	}
+	if r.MaxTokens < 1 {
+		return invalid("max_tokens", "Input should be greater than or equal to 1")
+	}
+
+	if err := r.validateMessages(); err != nil {
+		return err
+	}
+	for i, block := range r.System {
+		if block.Type != "text" {
+			return invalid(fmt.Sprintf("system.%d.type", i), "Input should be 'text'")
+		}
+	}
+
+	if r.Temperature != nil && (*r.Temperature < 0 || *r.Temperature > 1) {
+		return invalid("temperature", "Input should be between 0 and 1")
+	}
+	if r.TopP != nil && (*r.TopP < 0 || *r.TopP > 1) {
+		return invalid("top_p", "Input should be between 0 and 1")
+	}
+	if r.TopK != nil && *r.TopK < 0 {
+		return invalid("top_k", "Input should be greater than or equal to 0")
+	}
+	for i, seq := range r.StopSequences {
+		if strings.TrimSpace(seq) == "" {
+			return invalid(fmt.Sprintf("stop_sequences.%d", i), "each stop sequence must contain non-whitespace")
+		}
+	}
+
+	if err := r.validateTools(); err != nil {
+		return err
+	}
+
+	if t := r.Thinking; t != nil {
+		switch t.Type {
+		case "disabled":
+		case "enabled":
+			if t.BudgetTokens < 1024 {
+				return invalid("thinking.enabled.budget_tokens", "Input should be greater than or equal to 1024")
+			}
+			if t.BudgetTokens >= r.MaxTokens {
+				return invalid("max_tokens", "must be greater than thinking.budget_tokens")
+			}
+		default:
+			return invalid("thinking.type", "Input should be 'enabled' or 'disabled'")
+		}
+	}
+
+	switch r.ServiceTier {
+	case "", "auto", "standard_only":
+	default:
+		return invalid("service_tier", "Input should be 'auto' or 'standard_only'")
+	}
+	return nil
+}
+
+func (r *AnthropicRequest) validateMessages() error {
+	if len(r.Messages) == 0 {
+		return invalid("messages", "at least one message is required")
+	}
+	last := len(r.Messages) - 1
+	for i, msg := range r.Messages {
+		field := fmt.Sprintf("messages.%d", i)
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return invalid(field+".role", "Input should be 'user' or 'assistant'")
+		}
+
+		switch content := msg.Content.(type) {
+		case string:
+			if content == "" {
+				return invalid(field, "all messages must have non-empty content")
+			}
+		case []any:
+			if len(content) == 0 {
+				return invalid(field, "all messages must have non-empty content")
+			}
+			for j, block := range content {
+				if err := validateContentBlock(fmt.Sprintf("%s.content.%d", field, j), block); err != nil {
+					return err
+				}
+			}
+		default:
+			return invalid(field+".content", "Input should be a valid string or list of content blocks")
+		}
+	}
+	// A final assistant message is a prefill the response continues, as
+	// the Anthropic API does.
+	if r.Messages[last].Role == "assistant" && endsInWhitespace(r.Messages[last].Content) {
+		return invalid(fmt.Sprintf("messages.%d.content", last), "final assistant content cannot end with trailing whitespace")
+	}
+	return nil
+}
+
+// endsInWhitespace reports whether the text of content, or of its last
+// block, ends in whitespace.
+func endsInWhitespace(content any) bool {
+	text, _ := content.(string)
+	if blocks, ok := content.([]any); ok && len(blocks) > 0 {
+		if block, ok := blocks[len(blocks)-1].(map[string]any); ok {
+			text, _ = block["text"].(string)
+		}
+	}
+	return text != "" && strings.TrimRightFunc(text, unicode.IsSpace) != text
+}
+
+func validateContentBlock(field string, block any) error {
+	m, ok := block.(map[string]any)
+	if !ok {
+		return invalid(field, "Input should be a content block object")
+	}
+	blockType, _ := m["type"].(string)
+	switch blockType {
+	case "":
+		return invalid(field+".type", "Field required")
+	case "text":
+		if _, ok := m["text"].(string); !ok {
+			return invalid(field+".text", "Field required")
+		}
+	case "tool_use":
+		for _, key := range []string{"id", "name"} {
+			if v, _ := m[key].(string); v == "" {
+				return invalid(field+"."+key, "Field required")
+			}
+		}
+	case "tool_result":
+		if v, _ := m["tool_use_id"].(string); v == "" {
+			return invalid(field+".tool_use_id", "Field required")
+		}
+	}
+	return nil
+}
+
+func (r *AnthropicRequest) validateTools() error {
+	names := make(map[string]bool, len(r.Tools))
+	for i, tool := range r.Tools {
+		field := fmt.Sprintf("tools.%d", i)
+		if !toolNamePattern.MatchString(tool.Name) {
+			return invalid(field+".name", "String should match pattern '%s'", toolNamePattern)
+		}
+		if names[tool.Name] {
+			return invalid("tools", "Tool names must be unique, %q is repeated", tool.Name)
+		}
+		names[tool.Name] = true
+		if tool.IsCustom() && tool.InputSchema == nil {
+			return invalid(field+".input_schema", "Field required")
+		}
+	}
+
+	choice := r.ToolChoice
+	if choice == nil {
+		return nil
+	}
+	switch choice.Type {
+	case "auto", "none":
+	case "any":
+		if len(r.Tools) == 0 {
+			return invalid("tool_choice", "tool_choice 'any' requires tools")
+		}
+	case "tool":
+		if choice.Name == "" {
+			return invalid("tool_choice.tool.name", "Field required")
+		}
+		if !names[choice.Name] {
+			return invalid("tool_choice.tool.name", "no tool named %q in tools", choice.Name)
+		}
+	default:
+		return invalid("tool_choice.type", "Input should be 'auto', 'any', 'tool' or 'none'")
+	}
+	return nil
+}
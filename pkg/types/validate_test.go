@@ -0,0 +1,85 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string // empty when the request is valid
+	}{
+		{"minimal", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, ""},
+		{"full", `{"model":"m","max_tokens":2048,"system":"be brief",
+			"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]},
+				{"role":"assistant","content":[{"type":"tool_use","id":"t1","name":"get_weather","input":{}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"t1","content":"sunny"}]}],
+			"tools":[{"name":"get_weather","input_schema":{"type":"object"}},{"type":"web_search_20250305","name":"web_search"}],
+			"tool_choice":{"type":"tool","name":"get_weather"},
+			"stop_sequences":["END"],"temperature":0.5,"top_p":0.9,"top_k":40,
+			"thinking":{"type":"enabled","budget_tokens":1024},"service_tier":"auto","metadata":{"user_id":"u"}}`, ""},
+		{"no model", `{"max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, "model"},
+		{"no max_tokens", `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, "max_tokens"},
+		{"no messages", `{"model":"m","max_tokens":10,"messages":[]}`, "messages"},
+		{"bad role", `{"model":"m","max_tokens":10,"messages":[{"role":"system","content":"hi"}]}`, "messages.0.role"},
+		{"empty content", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":""}]}`, "messages.0"},
+		{"block without type", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":[{"text":"hi"}]}]}`, "messages.0.content.0.type"},
+		{"prefill", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"{"}]}`, ""},
+		{"prefill with trailing space", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"Answer: "}]}`, "messages.1.content"},
+		{"prefill block with trailing newline", `{"model":"m","max_tokens":10,"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":[{"type":"text","text":"{\n"}]}]}`, "messages.1.content"},
+		{"temperature", `{"model":"m","max_tokens":10,"temperature":1.5,"messages":[{"role":"user","content":"hi"}]}`, "temperature"},
+		{"blank stop sequence", `{"model":"m","max_tokens":10,"stop_sequences":[" "],"messages":[{"role":"user","content":"hi"}]}`, "stop_sequences.0"},
+		{"tool without schema", `{"model":"m","max_tokens":10,"tools":[{"name":"x"}],"messages":[{"role":"user","content":"hi"}]}`, "tools.0.input_schema"},
+		{"unknown tool_choice", `{"model":"m","max_tokens":10,"tools":[{"name":"x","input_schema":{}}],"tool_choice":{"type":"tool","name":"y"},"messages":[{"role":"user","content":"hi"}]}`, "tool_choice.tool.name"},
+		{"any without tools", `{"model":"m","max_tokens":10,"tool_choice":{"type":"any"},"messages":[{"role":"user","content":"hi"}]}`, "tool_choice"},
+		{"thinking budget", `{"model":"m","max_tokens":4000,"thinking":{"type":"enabled","budget_tokens":500},"messages":[{"role":"user","content":"hi"}]}`, "thinking.enabled.budget_tokens"},
+		{"thinking over max_tokens", `{"model":"m","max_tokens":1500,"thinking":{"type":"enabled","budget_tokens":1500},"messages":[{"role":"user","content":"hi"}]}`, "max_tokens"},
+		{"service tier", `{"model":"m","max_tokens":10,"service_tier":"priority","messages":[{"role":"user","content":"hi"}]}`, "service_tier"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req AnthropicRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatal(err)
+			}
+			err := req.Validate()
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want valid", err)
+				}
+				return
+			}
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want a ValidationError for %s", err, tt.field)
+			}
+			if verr.Field != tt.field {
+				t.Fatalf("Validate() = %v, want field %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestSystemStringOrBlocks(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"system":"be brief"}`: "be brief",
+		`{"system":[{"type":"text","text":"a"},{"type":"text","text":"b"}]}`: "a\n\nb",
+		`{"system":null}`: "",
+	} {
+		var req AnthropicRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if got := req.System.Text(); got != want {
+			t.Errorf("%s: System.Text() = %q, want %q", body, got, want)
+		}
+	}
+
+	var req AnthropicRequest
+	if err := json.Unmarshal([]byte(`{"system":42}`), &req); err == nil {
+		t.Error("a numeric system prompt was accepted")
+	}
+}